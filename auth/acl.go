@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/SteveWXT/pubsub/core"
+)
+
+type (
+	// An ACL restricts the tags a token may publish and subscribe to. Each rule is
+	// a tag set, and an action is allowed when one of its rules is a subset of the
+	// tags acted on; the same way a subscription matches a published message. A
+	// token without an ACL is unrestricted, while an ACL without any rules for an
+	// action denies it entirely
+	ACL struct {
+		Publish   [][]string `json:"publish"`
+		Subscribe [][]string `json:"subscribe"`
+
+		once      sync.Once
+		publish   *core.Node
+		subscribe *core.Node
+	}
+)
+
+// CanPublish returns true if the ACL allows publishing to [tags]
+func (acl *ACL) CanPublish(tags []string) bool {
+	if acl == nil {
+		return true
+	}
+
+	acl.once.Do(acl.compile)
+	return match(acl.publish, tags)
+}
+
+// CanSubscribe returns true if the ACL allows subscribing to [tags]
+func (acl *ACL) CanSubscribe(tags []string) bool {
+	if acl == nil {
+		return true
+	}
+
+	acl.once.Do(acl.compile)
+	return match(acl.subscribe, tags)
+}
+
+// compile adds the ACL rules to nodes so they can be matched against
+func (acl *ACL) compile() {
+	acl.publish = core.NewNode()
+	for _, rule := range acl.Publish {
+		acl.publish.Add(append([]string{}, rule...))
+	}
+
+	acl.subscribe = core.NewNode()
+	for _, rule := range acl.Subscribe {
+		acl.subscribe.Add(append([]string{}, rule...))
+	}
+}
+
+// match matches a copy of [tags] against [rules]; matching sorts the tags, which
+// shouldn't leak out to the caller
+func match(rules *core.Node, tags []string) bool {
+	return rules.Match(append([]string{}, tags...))
+}
+
+// AllowPublish returns an error if the connection authenticated with [token], or
+// the client certificate [identity], isn't allowed to publish to [tags]; without
+// an authenticator (or for the master token) everything is allowed
+func AllowPublish(token, identity string, tags []string) error {
+	acl, err := connectionACL(token, identity)
+	if err != nil || !acl.CanPublish(tags) {
+		return fmt.Errorf("Forbidden - not allowed to publish to '%s'", strings.Join(tags, ","))
+	}
+
+	return nil
+}
+
+// AllowSubscribe returns an error if the connection authenticated with [token],
+// or the client certificate [identity], isn't allowed to subscribe to [tags];
+// without an authenticator (or for the master token) everything is allowed
+func AllowSubscribe(token, identity string, tags []string) error {
+	acl, err := connectionACL(token, identity)
+	if err != nil || !acl.CanSubscribe(tags) {
+		return fmt.Errorf("Forbidden - not allowed to subscribe to '%s'", strings.Join(tags, ","))
+	}
+
+	return nil
+}
+
+// SubscribeFilter returns what an expression subscription made by the connection
+// authenticated with [token], or the client certificate [identity], is allowed to
+// receive; expressions can't be checked against the ACL up front, so the messages
+// they match are instead. A nil filter allows everything
+func SubscribeFilter(token, identity string) (func(tags []string) bool, error) {
+	acl, err := connectionACL(token, identity)
+	if err != nil || (acl != nil && len(acl.Subscribe) == 0) {
+		return nil, fmt.Errorf("Forbidden - not allowed to subscribe")
+	}
+
+	if acl == nil {
+		return nil, nil
+	}
+
+	return acl.CanSubscribe, nil
+}
+
+// connectionACL returns the ACL of a connection; a token, when one was provided,
+// takes precedence over a client certificate identity
+func connectionACL(token, identity string) (*ACL, error) {
+	authenticator := Default()
+
+	switch {
+	case authenticator == nil, IsMaster(token):
+		return nil, nil
+	case token == "" && identity != "":
+		return authenticator.IdentityACL(identity)
+	default:
+		return authenticator.ACL(token)
+	}
+}
@@ -0,0 +1,102 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/SteveWXT/pubsub/auth"
+)
+
+// TestACL tests that ACL rules allow tags the same way subscriptions match them
+func TestACL(t *testing.T) {
+	acl := &auth.ACL{
+		Publish:   [][]string{{"billing"}},
+		Subscribe: [][]string{{"billing"}, {"orders", "eu"}},
+	}
+
+	// publishing requires one of the rules to be a subset of the tags
+	if !acl.CanPublish([]string{"billing"}) {
+		t.Fatalf("Expected publish to be allowed!")
+	}
+	if !acl.CanPublish([]string{"invoice", "billing"}) {
+		t.Fatalf("Expected publish to be allowed!")
+	}
+	if acl.CanPublish([]string{"orders"}) {
+		t.Fatalf("Unexpected publish allowed!")
+	}
+
+	// compound rules need every tag
+	if !acl.CanSubscribe([]string{"eu", "orders"}) {
+		t.Fatalf("Expected subscribe to be allowed!")
+	}
+	if acl.CanSubscribe([]string{"orders"}) {
+		t.Fatalf("Unexpected subscribe allowed!")
+	}
+
+	// a missing rule set denies the action entirely
+	dashboard := &auth.ACL{Subscribe: [][]string{{"billing"}}}
+	if dashboard.CanPublish([]string{"billing"}) {
+		t.Fatalf("Unexpected publish allowed!")
+	}
+
+	// a nil ACL is unrestricted
+	var unrestricted *auth.ACL
+	if !unrestricted.CanPublish([]string{"anything"}) || !unrestricted.CanSubscribe([]string{"anything"}) {
+		t.Fatalf("Expected nil ACL to allow everything!")
+	}
+}
+
+// TestAllow tests that the configured authenticator's ACLs are enforced
+func TestAllow(t *testing.T) {
+	defer auth.SetDefault(nil)
+
+	// with no authenticator everything is allowed
+	if err := auth.AllowPublish("", "", []string{"billing"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+
+	if err := auth.Start("memory://?token=billing&token=dashboard&token=admin"); err != nil {
+		t.Fatalf("Failed to start - %s", err.Error())
+	}
+	auth.Default().SetACL("billing", &auth.ACL{Publish: [][]string{{"billing"}}})
+	auth.Default().SetACL("dashboard", &auth.ACL{Subscribe: [][]string{{"billing"}}})
+
+	if err := auth.AllowPublish("billing", "", []string{"billing"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	if err := auth.AllowSubscribe("billing", "", []string{"billing"}); err == nil {
+		t.Fatalf("Unexpected subscribe allowed!")
+	}
+	if err := auth.AllowSubscribe("dashboard", "", []string{"billing"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	if err := auth.AllowPublish("dashboard", "", []string{"billing"}); err == nil {
+		t.Fatalf("Unexpected publish allowed!")
+	}
+	if err := auth.AllowPublish("admin", "", []string{"anything"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+
+	// unknown tokens aren't allowed anything
+	if err := auth.AllowPublish("bogus", "", []string{"billing"}); err == nil {
+		t.Fatalf("Unexpected publish allowed!")
+	}
+	if err := auth.Default().SetACL("bogus", nil); err != auth.ErrTokenNotFound {
+		t.Fatalf("Set ACL of missing token")
+	}
+
+	// connections identified by a client certificate use their identity's ACL,
+	// and are unrestricted without one
+	if err := auth.Default().SetIdentityACL("", nil); err != auth.ErrMissingIdentity {
+		t.Fatalf("Set ACL of empty identity")
+	}
+	auth.Default().SetIdentityACL("billing-service", &auth.ACL{Publish: [][]string{{"billing"}}})
+	if err := auth.AllowPublish("", "billing-service", []string{"billing"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	if err := auth.AllowSubscribe("", "billing-service", []string{"billing"}); err == nil {
+		t.Fatalf("Unexpected subscribe allowed!")
+	}
+	if err := auth.AllowSubscribe("", "ops", []string{"billing"}); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+}
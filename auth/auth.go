@@ -0,0 +1,162 @@
+// Package auth provides pluggable token authentication for pubsub connections
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// defaultAuth is the authenticator consulted by the pubsub listeners; if it's
+	// nil, connections aren't required to authenticate. It's read by every
+	// connection, so it's only got at with Default and SetDefault
+	defaultAuth Authenticator
+	defaultTex  sync.RWMutex
+
+	// MasterToken authenticates admin connections, which may manage tokens over
+	// the wire and aren't restricted by any ACL; it isn't stored by the authenticator
+	MasterToken string
+
+	// ErrUnauthorized is returned when a connection provides a bad token (or none)
+	ErrUnauthorized = errors.New("Unauthorized - bad or missing token")
+
+	// ErrMissingToken is returned when adding an empty token
+	ErrMissingToken = errors.New("Missing token")
+
+	// ErrMissingIdentity is returned when setting the ACL of an empty identity
+	ErrMissingIdentity = errors.New("Missing identity")
+
+	// ErrTokenNotFound is returned when removing a token that doesn't exist
+	ErrTokenNotFound = errors.New("Token not found")
+
+	// ErrIdentityNotFound is returned when removing the ACL of an identity that
+	// doesn't have one
+	ErrIdentityNotFound = errors.New("Identity not found")
+
+	// ErrTokenExist is returned when adding a token that already exists
+	ErrTokenExist = errors.New("Token already exists")
+
+	// ErrNotConfigured is returned when managing tokens without an authenticator
+	ErrNotConfigured = errors.New("Authentication not configured")
+
+	// ErrNotAdmin is returned when a connection that didn't authenticate with the
+	// master token tries to run an admin command
+	ErrNotAdmin = errors.New("Forbidden - admin commands require the master token")
+
+	// this is a map of the supported authenticators that can be started by pubsub
+	authenticators = map[string]handleFunc{}
+	authTex        sync.RWMutex
+)
+
+type (
+	// Authenticator stores the tokens connections are allowed to authenticate with,
+	// and the ACL restricting what each of them may do. It also stores ACLs for
+	// the identities of connections authenticated by a client certificate
+	Authenticator interface {
+		AddToken(token string, acl *ACL) error
+		RemoveToken(token string) error
+		Authenticate(token string) error
+		SetACL(token string, acl *ACL) error
+		ACL(token string) (*ACL, error)
+		SetIdentityACL(identity string, acl *ACL) error
+		IdentityACL(identity string) (*ACL, error)
+		Tokens() ([]Token, error)
+	}
+
+	// A Token is a credential stored by an authenticator; either a token, or the
+	// identity of a client certificate, and its ACL
+	Token struct {
+		Token    string `json:"token,omitempty"`
+		Identity string `json:"identity,omitempty"`
+		ACL      *ACL   `json:"acl,omitempty"`
+	}
+
+	handleFunc func(url *url.URL) (Authenticator, error)
+)
+
+// Register registers a new pubsub authenticator
+func Register(name string, auth handleFunc) {
+	authTex.Lock()
+	authenticators[name] = auth
+	authTex.Unlock()
+}
+
+// Start attempts to start the authenticator described by [uri]
+// (scheme:[//[user:pass@]host[:port]][/]path[?query][#fragment]); an empty
+// uri leaves authentication disabled
+func Start(uri string) error {
+	if uri == "" {
+		return nil
+	}
+
+	// parse the uri string into a url object
+	url, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	// check to see if the scheme is supported
+	authTex.RLock()
+	auth, ok := authenticators[url.Scheme]
+	authTex.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unsupported authenticator '%s'", url.Scheme)
+	}
+
+	lumber.Info("Starting '%s' authenticator...", url.Scheme)
+	authenticator, err := auth(url)
+	if err != nil {
+		return fmt.Errorf("Failed to start '%s' authenticator - %s", url.Scheme, err.Error())
+	}
+
+	SetDefault(authenticator)
+
+	return nil
+}
+
+// Default returns the authenticator consulted by the pubsub listeners; nil if
+// connections aren't required to authenticate
+func Default() Authenticator {
+	defaultTex.RLock()
+	defer defaultTex.RUnlock()
+
+	return defaultAuth
+}
+
+// SetDefault sets the authenticator consulted by the pubsub listeners; nil
+// stops requiring connections to authenticate
+func SetDefault(authenticator Authenticator) {
+	defaultTex.Lock()
+	defaultAuth = authenticator
+	defaultTex.Unlock()
+}
+
+// IsConfigured returns true if connections are required to authenticate
+func IsConfigured() bool {
+	return Default() != nil
+}
+
+// Authenticate returns ErrUnauthorized unless [token] is the master token or a
+// token stored by the configured authenticator
+func Authenticate(token string) error {
+	if IsMaster(token) {
+		return nil
+	}
+
+	authenticator := Default()
+	if authenticator == nil {
+		return ErrUnauthorized
+	}
+
+	return authenticator.Authenticate(token)
+}
+
+// IsMaster returns true if [token] is the master token
+func IsMaster(token string) bool {
+	return MasterToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(MasterToken)) == 1
+}
@@ -0,0 +1,147 @@
+package auth_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SteveWXT/pubsub/auth"
+)
+
+// TestStartUnsupported tests that an unknown authenticator fails to start
+func TestStartUnsupported(t *testing.T) {
+	defer auth.SetDefault(nil)
+
+	if err := auth.Start("bogus://"); err == nil {
+		t.Fatalf("Unsupported authenticator started")
+	}
+	if auth.IsConfigured() {
+		t.Fatalf("Authenticator unexpectedly configured")
+	}
+
+	// an empty uri leaves authentication disabled
+	if err := auth.Start(""); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	if auth.IsConfigured() {
+		t.Fatalf("Authenticator unexpectedly configured")
+	}
+}
+
+// TestMemory tests adding, authenticating and removing tokens in memory
+func TestMemory(t *testing.T) {
+	defer auth.SetDefault(nil)
+
+	if err := auth.Start("memory://?token=seed"); err != nil {
+		t.Fatalf("Failed to start - %s", err.Error())
+	}
+	if !auth.IsConfigured() {
+		t.Fatalf("Authenticator not configured")
+	}
+
+	testTokens(auth.Default(), t)
+}
+
+// TestFile tests that tokens added to a file authenticator survive a restart
+func TestFile(t *testing.T) {
+	defer auth.SetDefault(nil)
+
+	dir, err := ioutil.TempDir("", "pubsub-auth")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	uri := "file://" + filepath.Join(dir, "tokens.json")
+
+	if err := auth.Start(uri); err != nil {
+		t.Fatalf("Failed to start - %s", err.Error())
+	}
+	if err := auth.Default().AddToken("seed", &auth.ACL{Publish: [][]string{{"billing"}}}); err != nil {
+		t.Fatalf("Failed to add token - %s", err.Error())
+	}
+
+	testTokens(auth.Default(), t)
+
+	if err := auth.Default().SetIdentityACL("billing-service", &auth.ACL{Subscribe: [][]string{{"billing"}}}); err != nil {
+		t.Fatalf("Failed to set identity ACL - %s", err.Error())
+	}
+
+	// restart; the tokens and identities left over should have been saved
+	if err := auth.Start(uri); err != nil {
+		t.Fatalf("Failed to restart - %s", err.Error())
+	}
+	if err := auth.Default().Authenticate("seed"); err != nil {
+		t.Fatalf("Saved token failed to authenticate - %s", err.Error())
+	}
+	if err := auth.Default().Authenticate("abc"); err != auth.ErrUnauthorized {
+		t.Fatalf("Removed token authenticated")
+	}
+	acl, err := auth.Default().ACL("seed")
+	if err != nil {
+		t.Fatalf("Failed to get ACL - %s", err.Error())
+	}
+	if !acl.CanPublish([]string{"billing"}) || acl.CanSubscribe([]string{"billing"}) {
+		t.Fatalf("Saved ACL not restored - %#v", acl)
+	}
+	acl, err = auth.Default().IdentityACL("billing-service")
+	if err != nil {
+		t.Fatalf("Failed to get identity ACL - %s", err.Error())
+	}
+	if acl.CanPublish([]string{"billing"}) || !acl.CanSubscribe([]string{"billing"}) {
+		t.Fatalf("Saved identity ACL not restored - %#v", acl)
+	}
+
+	// a change that can't be saved isn't made
+	os.RemoveAll(dir)
+	if err := auth.Default().AddToken("unsaved", nil); err == nil {
+		t.Fatalf("Expected adding a token that can't be saved to fail")
+	}
+	if err := auth.Default().Authenticate("unsaved"); err != auth.ErrUnauthorized {
+		t.Fatalf("Unsaved token authenticated")
+	}
+	if err := auth.Default().RemoveToken("seed"); err == nil {
+		t.Fatalf("Expected removing a token that can't be saved to fail")
+	}
+	if err := auth.Default().Authenticate("seed"); err != nil {
+		t.Fatalf("Token that failed to be removed no longer authenticates - %s", err.Error())
+	}
+}
+
+// testTokens runs an authenticator (seeded with the token 'seed') through adding,
+// authenticating with and removing tokens
+func testTokens(a auth.Authenticator, t *testing.T) {
+	if err := a.Authenticate("seed"); err != nil {
+		t.Fatalf("Seed token failed to authenticate - %s", err.Error())
+	}
+	if err := a.Authenticate(""); err != auth.ErrUnauthorized {
+		t.Fatalf("Empty token authenticated")
+	}
+	if err := a.Authenticate("abc"); err != auth.ErrUnauthorized {
+		t.Fatalf("Unknown token authenticated")
+	}
+
+	if err := a.AddToken("", nil); err != auth.ErrMissingToken {
+		t.Fatalf("Empty token added")
+	}
+	if err := a.AddToken("abc", nil); err != nil {
+		t.Fatalf("Failed to add token - %s", err.Error())
+	}
+	if err := a.AddToken("abc", nil); err != auth.ErrTokenExist {
+		t.Fatalf("Duplicate token added")
+	}
+	if err := a.Authenticate("abc"); err != nil {
+		t.Fatalf("Added token failed to authenticate - %s", err.Error())
+	}
+
+	if err := a.RemoveToken("abc"); err != nil {
+		t.Fatalf("Failed to remove token - %s", err.Error())
+	}
+	if err := a.RemoveToken("abc"); err != auth.ErrTokenNotFound {
+		t.Fatalf("Removed missing token")
+	}
+	if err := a.Authenticate("abc"); err != auth.ErrUnauthorized {
+		t.Fatalf("Removed token authenticated")
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// init adds "file" as an available authenticator
+func init() {
+	Register("file", NewFile)
+}
+
+type (
+	// file is an in-memory authenticator that saves its tokens to a json file
+	// every time they change, and loads them again on start
+	file struct {
+		*memory
+
+		path    string
+		saveTex sync.Mutex // changes are saved one at a time
+	}
+)
+
+// NewFile creates a new file-backed authenticator that stores its tokens at the
+// uri path (file:///etc/pubsub/tokens.json); the file is created if it doesn't
+// already exist
+func NewFile(url *url.URL) (Authenticator, error) {
+	mem, err := newMemory(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{memory: mem, path: url.Host + url.Path}
+	if f.path == "" {
+		return nil, fmt.Errorf("Missing token file path")
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// AddToken adds a token and saves the token file
+func (f *file) AddToken(token string, acl *ACL) error {
+	return f.change(func(mem *memory) error {
+		return mem.AddToken(token, acl)
+	})
+}
+
+// RemoveToken removes a token and saves the token file
+func (f *file) RemoveToken(token string) error {
+	return f.change(func(mem *memory) error {
+		return mem.RemoveToken(token)
+	})
+}
+
+// SetACL replaces the ACL of a token and saves the token file
+func (f *file) SetACL(token string, acl *ACL) error {
+	return f.change(func(mem *memory) error {
+		return mem.SetACL(token, acl)
+	})
+}
+
+// SetIdentityACL replaces the ACL of a certificate identity and saves the token
+// file
+func (f *file) SetIdentityACL(identity string, acl *ACL) error {
+	return f.change(func(mem *memory) error {
+		return mem.SetIdentityACL(identity, acl)
+	})
+}
+
+// change makes a change to a copy of the tokens and saves the copy; the tokens
+// are only replaced with it once it's saved, so a change that fails to save
+// isn't left in effect
+func (f *file) change(fn func(mem *memory) error) error {
+	f.saveTex.Lock()
+	defer f.saveTex.Unlock()
+
+	changed := f.memory.copy()
+	if err := fn(changed); err != nil {
+		return err
+	}
+
+	if err := f.save(changed); err != nil {
+		return err
+	}
+
+	f.memory.Lock()
+	f.memory.tokens, f.memory.identities = changed.tokens, changed.identities
+	f.memory.Unlock()
+
+	return nil
+}
+
+// load reads the token file into memory; a missing file is treated as empty
+func (f *file) load() error {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed to read token file - %s", err.Error())
+	}
+
+	tokens := []Token{}
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("Failed to parse token file - %s", err.Error())
+	}
+
+	f.memory.Lock()
+	for _, token := range tokens {
+		if token.Identity != "" {
+			f.memory.identities[token.Identity] = token
+			continue
+		}
+		f.memory.tokens[token.Token] = token
+	}
+	f.memory.Unlock()
+
+	return nil
+}
+
+// save writes every token in [mem] to the token file; it writes to a temporary
+// file first so a failed write never leaves a half written token file behind
+func (f *file) save(mem *memory) error {
+	tokens, err := mem.Tokens()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode tokens - %s", err.Error())
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".tokens")
+	if err != nil {
+		return fmt.Errorf("Failed to save token file - %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to save token file - %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to save token file - %s", err.Error())
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("Failed to save token file - %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"net/url"
+	"sync"
+)
+
+// init adds "memory" as an available authenticator
+func init() {
+	Register("memory", NewMemory)
+}
+
+type (
+	// memory is an authenticator that keeps its tokens in memory; they're lost
+	// when the server stops
+	memory struct {
+		sync.RWMutex
+
+		tokens     map[string]Token // by token
+		identities map[string]Token // by certificate identity
+	}
+)
+
+// NewMemory creates a new in-memory authenticator, seeded with any tokens
+// provided in the uri query (memory://?token=abc&token=def)
+func NewMemory(url *url.URL) (Authenticator, error) {
+	return newMemory(url.Query()["token"])
+}
+
+// newMemory creates a new in-memory authenticator seeded with [tokens]
+func newMemory(tokens []string) (*memory, error) {
+	mem := &memory{tokens: map[string]Token{}, identities: map[string]Token{}}
+
+	for _, token := range tokens {
+		if err := mem.AddToken(token, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return mem, nil
+}
+
+// AddToken adds a token connections are allowed to authenticate with, restricted
+// by [acl]; a nil ACL leaves the token unrestricted
+func (mem *memory) AddToken(token string, acl *ACL) error {
+	if token == "" {
+		return ErrMissingToken
+	}
+
+	mem.Lock()
+	defer mem.Unlock()
+
+	if _, ok := mem.tokens[token]; ok {
+		return ErrTokenExist
+	}
+
+	mem.tokens[token] = Token{Token: token, ACL: acl}
+
+	return nil
+}
+
+// RemoveToken removes a token; connections already authenticated with it are
+// left connected
+func (mem *memory) RemoveToken(token string) error {
+	mem.Lock()
+	defer mem.Unlock()
+
+	if _, ok := mem.tokens[token]; !ok {
+		return ErrTokenNotFound
+	}
+
+	delete(mem.tokens, token)
+
+	return nil
+}
+
+// Authenticate returns ErrUnauthorized if [token] isn't a known token
+func (mem *memory) Authenticate(token string) error {
+	mem.RLock()
+	defer mem.RUnlock()
+
+	if _, ok := mem.tokens[token]; !ok {
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// SetACL replaces the ACL of [token]; a nil ACL leaves the token unrestricted
+func (mem *memory) SetACL(token string, acl *ACL) error {
+	mem.Lock()
+	defer mem.Unlock()
+
+	t, ok := mem.tokens[token]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	t.ACL = acl
+	mem.tokens[token] = t
+
+	return nil
+}
+
+// ACL returns the ACL of [token]
+func (mem *memory) ACL(token string) (*ACL, error) {
+	mem.RLock()
+	defer mem.RUnlock()
+
+	t, ok := mem.tokens[token]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	return t.ACL, nil
+}
+
+// SetIdentityACL replaces the ACL of a certificate [identity]; a nil ACL removes
+// it, leaving the identity unrestricted
+func (mem *memory) SetIdentityACL(identity string, acl *ACL) error {
+	if identity == "" {
+		return ErrMissingIdentity
+	}
+
+	mem.Lock()
+	defer mem.Unlock()
+
+	if acl == nil {
+		delete(mem.identities, identity)
+		return nil
+	}
+
+	mem.identities[identity] = Token{Identity: identity, ACL: acl}
+
+	return nil
+}
+
+// IdentityACL returns the ACL of a certificate [identity]; identities without
+// one are unrestricted, since the certificate authority has vouched for them
+func (mem *memory) IdentityACL(identity string) (*ACL, error) {
+	mem.RLock()
+	defer mem.RUnlock()
+
+	return mem.identities[identity].ACL, nil
+}
+
+// copy returns a copy of the authenticator, with its own tokens
+func (mem *memory) copy() *memory {
+	mem.RLock()
+	defer mem.RUnlock()
+
+	c := &memory{tokens: make(map[string]Token, len(mem.tokens)), identities: make(map[string]Token, len(mem.identities))}
+	for token, t := range mem.tokens {
+		c.tokens[token] = t
+	}
+	for identity, t := range mem.identities {
+		c.identities[identity] = t
+	}
+
+	return c
+}
+
+// Tokens returns every token, and identity ACL, the authenticator knows about
+func (mem *memory) Tokens() ([]Token, error) {
+	mem.RLock()
+	defer mem.RUnlock()
+
+	tokens := make([]Token, 0, len(mem.tokens)+len(mem.identities))
+	for _, token := range mem.tokens {
+		tokens = append(tokens, token)
+	}
+	for _, identity := range mem.identities {
+		tokens = append(tokens, identity)
+	}
+
+	return tokens, nil
+}
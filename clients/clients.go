@@ -1,36 +1,155 @@
 package clients
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jcelliott/lumber"
 
+	"github.com/SteveWXT/pubsub/auth"
 	"github.com/SteveWXT/pubsub/core"
 )
 
 type (
 	// TCP represents a TCP connection to the core server
 	TCP struct {
-		conn     io.ReadWriteCloser // the connection to the core server
-		encoder  *json.Encoder      //
-		host     string             //
-		messages chan core.Message  // the channel that core server 'publishes' updates to
+		host     string            //
+		messages chan core.Message // the channel that core server 'publishes' updates to
+		token    string            // the token used to authenticate with the core server
+		tls      *tls.Config       // when set, the client connects over tls
+		timeout  time.Duration     // how long to wait for the reply to a request
+
+		// the current connection; guarded by connTex
+		conn      io.ReadWriteCloser // the connection to the core server
+		encoder   *json.Encoder      //
+		done      chan struct{}      // closed when the connection is lost
+		connected bool               // whether requests can be sent
+		connTex   sync.Mutex
+
+		// replies to requests are routed by their request id to whoever is waiting
+		// on them, rather than to messages
+		pending    map[string]chan core.Message
+		pendingTex sync.Mutex
+		requests   uint64 // the last request id used
+
+		// messages that aren't replies wait here until they're read; when it's full,
+		// overflow decides what gives, like a subscriber's queue on the server
+		inbox     []core.Message
+		inboxTex  sync.Mutex
+		inboxed   chan struct{} // signaled when messages are added to the inbox
+		inboxSize int           //
+		overflow  string        //
+		dropped   uint64        // messages dropped by a full inbox
+
+		// reconnecting; see WithReconnect
+		backoffMin    time.Duration   // zero when the client doesn't reconnect
+		backoffMax    time.Duration   //
+		bufferSize    int             // how many publishes are kept while disconnected
+		buffered      []core.Message  // publishes waiting to be sent; guarded by connTex
+		subscriptions []core.Message  // the subscribes to make again; guarded by connTex
+		states        chan StateEvent //
+		closed        chan struct{}   // closed once the client is done with, for good
+		close         sync.Once       //
+
+		optionErr error // set by an option given a bad value
 	}
+
+	// An Option configures an optional client setting
+	Option func(*TCP)
+)
+
+var (
+	// DefaultTimeout is how long a client waits for the reply to a request, unless
+	// it's created with WithTimeout
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultInboxSize is the most received messages a client keeps waiting to be
+	// read from Messages, unless it's created with WithInbox
+	DefaultInboxSize = 1000
 )
 
 // New attempts to connect to a running core server at the clients specified
 // host and port.
-func New(host string) (*TCP, error) {
+func New(host string, opts ...Option) (*TCP, error) {
 	client := &TCP{
-		host:     host,
-		messages: make(chan core.Message),
+		host:      host,
+		messages:  make(chan core.Message),
+		timeout:   DefaultTimeout,
+		pending:   map[string]chan core.Message{},
+		inboxed:   make(chan struct{}, 1),
+		inboxSize: DefaultInboxSize,
+		overflow:  core.DropOldest,
+		states:    make(chan StateEvent, stateBuffer),
+		closed:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(client)
+	}
+	if client.optionErr != nil {
+		close(client.messages)
+		return client, client.optionErr
+	}
+
+	// the first connection has to succeed, even for a client that reconnects
+	if err := client.connect(); err != nil {
+		close(client.messages)
+		return client, err
 	}
 
-	return client, client.connect()
+	go client.forward()
+
+	return client, nil
+}
+
+// WithTLS has the client connect to a tls listener using [config]; this is where
+// a CA pool to verify the server with (RootCAs), or skipping verification for
+// development (InsecureSkipVerify), are configured
+func WithTLS(config *tls.Config) Option {
+	return func(c *TCP) {
+		c.tls = config
+	}
+}
+
+// WithToken has the client authenticate with [token] when it connects; servers
+// without an authenticator ignore it
+func WithToken(token string) Option {
+	return func(c *TCP) {
+		c.token = token
+	}
+}
+
+// WithTimeout has the client wait [timeout] for the reply to a request before
+// giving up on it
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *TCP) {
+		c.timeout = timeout
+	}
+}
+
+// WithInbox has the client keep up to [size] received messages waiting to be
+// read from Messages; once it has [size], the overflow [policy] decides whether
+// the oldest message or the new one is dropped (core.DropOldest, the default, or
+// core.DropNewest), or the connection closed (core.Disconnect)
+func WithInbox(size int, policy string) Option {
+	return func(c *TCP) {
+		if size < 1 {
+			c.optionErr = fmt.Errorf("Bad inbox size %d - the inbox needs room for at least 1 message", size)
+			return
+		}
+		if err := core.ValidOverflowPolicy(policy); err != nil {
+			c.optionErr = err
+			return
+		}
+		c.inboxSize, c.overflow = size, policy
+	}
 }
 
 // connect dials the remote core server and handles any incoming responses back
@@ -38,26 +157,42 @@ func New(host string) (*TCP, error) {
 func (c *TCP) connect() error {
 
 	// attempt to connect to the server
-	conn, err := net.Dial("tcp", c.host)
+	conn, err := c.dial()
 	if err != nil {
 		return fmt.Errorf("Failed to dial '%s' - %s", c.host, err.Error())
 	}
 
-	// set the connection for the client
-	c.conn = conn
-
 	// create a new json encoder for the clients connection
-	c.encoder = json.NewEncoder(c.conn)
+	encoder := json.NewEncoder(conn)
+
+	// if the client was created with a token, authenticate before anything else
+	if c.token != "" {
+		if err := encoder.Encode(&core.Message{Command: "auth", Data: c.token}); err != nil {
+			conn.Close()
+			return fmt.Errorf("Failed to authenticate - %s", err.Error())
+		}
+	}
 
 	// ensure we are authorized/still connected (unauthorized clients get disconnected)
-	c.Ping()
+	encoder.Encode(&core.Message{Command: "ping"})
 	decoder := json.NewDecoder(conn)
 	msg := core.Message{}
 	if err := decoder.Decode(&msg); err != nil {
 		conn.Close()
-		close(c.messages)
 		return fmt.Errorf("Ping failed, possibly bad token, or can't read from core - %s", err.Error())
 	}
+	if msg.Error != "" {
+		conn.Close()
+		return fmt.Errorf("Ping failed - %s", msg.Error)
+	}
+
+	// set the connection for the client; a client that's reconnecting only takes
+	// requests once it's resubscribed
+	done := make(chan struct{})
+	c.connTex.Lock()
+	c.connected = c.conn == nil
+	c.conn, c.encoder, c.done = conn, encoder, done
+	c.connTex.Unlock()
 
 	// connection loop (blocking); continually read off the connection. Once something
 	// is read, check to see if it's a message the client understands to be one of
@@ -78,10 +213,21 @@ func (c *TCP) connect() error {
 					lumber.Error("[pubsub client] Failed to get message from pubsub - %s", err.Error())
 				}
 				conn.Close()
-				close(c.messages)
+				c.lost(done, err)
 				return
 			}
-			c.messages <- msg // read from this using the .Messages() function
+
+			// replies to requests go to whoever sent them
+			if msg.RequestID != "" && c.reply(msg) {
+				continue
+			}
+
+			// a reader too slow to keep up loses the connection; the decoder fails next
+			if !c.keep(msg) {
+				lumber.Debug("[pubsub client] Inbox overflowed, disconnecting")
+				conn.Close()
+				continue
+			}
 			lumber.Trace("[pubsub client] Received message - %#v", msg)
 		}
 	}()
@@ -89,35 +235,332 @@ func (c *TCP) connect() error {
 	return nil
 }
 
-// Ping the server
+// keep adds a received message to the inbox; when it's full, the overflow policy
+// decides whether the oldest message or this one is dropped, or the connection
+// is closed (false)
+func (c *TCP) keep(msg core.Message) bool {
+	c.inboxTex.Lock()
+	if len(c.inbox) >= c.inboxSize {
+		atomic.AddUint64(&c.dropped, 1)
+
+		switch c.overflow {
+		case core.DropNewest:
+			c.inboxTex.Unlock()
+			return true
+		case core.Disconnect:
+			c.inboxTex.Unlock()
+			return false
+		default:
+			c.inbox = c.inbox[1:]
+		}
+	}
+	c.inbox = append(c.inbox, msg)
+	c.inboxTex.Unlock()
+
+	select {
+	case c.inboxed <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// Dropped returns how many received messages the client has dropped, because
+// its inbox was full
+func (c *TCP) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// forward sends the messages received down the messages channel, in order; they
+// wait in the inbox, so a slow reader never holds up the replies to requests
+func (c *TCP) forward() {
+	defer close(c.messages)
+
+	for {
+		closed := false
+		select {
+		case <-c.inboxed:
+		case <-c.closed:
+			closed = true
+		}
+
+		// taken one at a time, so what's waiting to be read is never more than
+		// the inbox holds
+		for {
+			c.inboxTex.Lock()
+			if len(c.inbox) == 0 {
+				c.inboxTex.Unlock()
+				break
+			}
+			msg := c.inbox[0]
+			c.inbox = c.inbox[1:]
+			c.inboxTex.Unlock()
+
+			c.messages <- msg // read from this using the .Messages() function
+		}
+
+		if closed {
+			return
+		}
+	}
+}
+
+// dial connects to the server, over tls if the client was configured with it
+func (c *TCP) dial() (net.Conn, error) {
+	if c.tls != nil {
+		return tls.Dial("tcp", c.host, c.tls)
+	}
+
+	return net.Dial("tcp", c.host)
+}
+
+// request sends a command to the server and waits for the reply to it, which
+// is returned as an error if it is one
+func (c *TCP) request(msg core.Message) (core.Message, error) {
+	return c.requestWithin(msg, c.timeout)
+}
+
+// requestWithin is request, waiting [timeout] for the reply; subscriptions it
+// makes are remembered, to be made again if the client reconnects
+func (c *TCP) requestWithin(msg core.Message, timeout time.Duration) (core.Message, error) {
+	c.connTex.Lock()
+	if !c.connected {
+		defer c.connTex.Unlock()
+
+		// publishes wait for the client to reconnect, if there's room
+		if msg.Command == "publish" && len(c.buffered) < c.bufferSize && c.reconnects() {
+			c.buffered = append(c.buffered, msg)
+			return core.Message{}, ErrBuffered
+		}
+		return core.Message{}, ErrDisconnected
+	}
+	encoder, done := c.encoder, c.done
+	c.connTex.Unlock()
+
+	res, err := c.send(msg, encoder, done, timeout)
+	if err == nil {
+		c.remember(msg)
+	}
+	return res, err
+}
+
+// send sends a command down the connection with [encoder], and waits for the
+// reply to it until the connection is [done] or [timeout]
+func (c *TCP) send(msg core.Message, encoder *json.Encoder, done chan struct{}, timeout time.Duration) (core.Message, error) {
+	msg.RequestID = strconv.FormatUint(atomic.AddUint64(&c.requests, 1), 10)
+
+	reply := make(chan core.Message, 1)
+	c.pendingTex.Lock()
+	c.pending[msg.RequestID] = reply
+	c.pendingTex.Unlock()
+
+	defer func() {
+		c.pendingTex.Lock()
+		delete(c.pending, msg.RequestID)
+		c.pendingTex.Unlock()
+	}()
+
+	if err := encoder.Encode(&msg); err != nil {
+		return core.Message{}, err
+	}
+
+	select {
+	case res := <-reply:
+		if res.Error != "" {
+			return res, fmt.Errorf("%s", res.Error)
+		}
+		return res, nil
+	case <-done:
+		return core.Message{}, fmt.Errorf("Connection closed waiting on '%s'", msg.Command)
+	case <-time.After(timeout):
+		return core.Message{}, fmt.Errorf("Timed out waiting on '%s'", msg.Command)
+	}
+}
+
+// reply hands a reply to whoever is waiting on its request, returning false if
+// nothing is (it timed out, or the request id wasn't ours)
+func (c *TCP) reply(msg core.Message) bool {
+	c.pendingTex.Lock()
+	reply, ok := c.pending[msg.RequestID]
+	delete(c.pending, msg.RequestID)
+	c.pendingTex.Unlock()
+
+	if ok {
+		reply <- msg
+	}
+	return ok
+}
+
+// Ping pings the server, waiting for its pong
 func (c *TCP) Ping() error {
-	return c.encoder.Encode(&core.Message{Command: "ping"})
+	_, err := c.request(core.Message{Command: "ping"})
+	return err
 }
 
 // Subscribe takes the specified tags and tells the server to subscribe to updates
-// on those tags, returning the tags and an error or nil
+// on those tags, waiting for it to ack; returning its error if it refused, or nil
 func (c *TCP) Subscribe(tags []string) error {
 
 	if len(tags) == 0 {
 		return fmt.Errorf("Unable to subscribe - missing tags")
 	}
 
-	return c.encoder.Encode(&core.Message{Command: "subscribe", Tags: tags})
+	_, err := c.request(core.Message{Command: "subscribe", Tags: tags})
+	return err
 }
 
 // Unsubscribe takes the specified tags and tells the server to unsubscribe from
-// updates on those tags, returning an error or nil
+// updates on those tags, waiting for it to ack; returning an error or nil
 func (c *TCP) Unsubscribe(tags []string) error {
 
 	if len(tags) == 0 {
 		return fmt.Errorf("Unable to unsubscribe - missing tags")
 	}
 
-	return c.encoder.Encode(&core.Message{Command: "unsubscribe", Tags: tags})
+	_, err := c.request(core.Message{Command: "unsubscribe", Tags: tags})
+	return err
+}
+
+// SubscribeFiltered tells the server to subscribe to updates on the tags whose
+// data matches the filter, like "severity >= 3"
+func (c *TCP) SubscribeFiltered(tags []string, filter string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe", Tags: tags, Filter: filter})
+	return err
+}
+
+// UnsubscribeFiltered tells the server to unsubscribe from the tags filtered by
+// the filter
+func (c *TCP) UnsubscribeFiltered(tags []string, filter string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to unsubscribe - missing tags")
+	}
+
+	_, err := c.request(core.Message{Command: "unsubscribe", Tags: tags, Filter: filter})
+	return err
+}
+
+// SubscribeExpr tells the server to subscribe to updates on tags satisfying the
+// expression, like "(orders AND eu) OR refunds", whose data matches the filter
+// (if there is one)
+func (c *TCP) SubscribeExpr(expr, filter string) error {
+
+	if expr == "" {
+		return fmt.Errorf("Unable to subscribe - missing expression")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe.expr", Data: expr, Filter: filter})
+	return err
+}
+
+// UnsubscribeExpr tells the server to unsubscribe from the expression (with the
+// filter it was subscribed with)
+func (c *TCP) UnsubscribeExpr(expr, filter string) error {
+
+	if expr == "" {
+		return fmt.Errorf("Unable to unsubscribe - missing expression")
+	}
+
+	_, err := c.request(core.Message{Command: "unsubscribe.expr", Data: expr, Filter: filter})
+	return err
+}
+
+// SubscribeReplay subscribes like SubscribeFiltered, having the server first
+// replay the messages in its log from [offset], or published since [since] (when
+// it isn't zero), before those published from now on
+func (c *TCP) SubscribeReplay(tags []string, filter string, offset uint64, since time.Time) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe", Tags: tags, Filter: filter, Offset: offset, Timestamp: unixNano(since)})
+	return err
+}
+
+// SubscribeExprReplay subscribes like SubscribeExpr, replaying the server's log
+// like SubscribeReplay
+func (c *TCP) SubscribeExprReplay(expr, filter string, offset uint64, since time.Time) error {
+
+	if expr == "" {
+		return fmt.Errorf("Unable to subscribe - missing expression")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe.expr", Data: expr, Filter: filter, Offset: offset, Timestamp: unixNano(since)})
+	return err
+}
+
+// SubscribeGroup subscribes to the tags (whose data matches the filter, if there
+// is one) as a member of the consumer group; each message goes to one member of
+// the group, and is redelivered until it's acked with Ack
+func (c *TCP) SubscribeGroup(group string, tags []string, filter string) error {
+
+	if group == "" {
+		return fmt.Errorf("Unable to subscribe - missing group")
+	}
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe", Group: group, Tags: tags, Filter: filter})
+	return err
+}
+
+// SubscribeGroupExpr subscribes to the expression as a member of the consumer
+// group, like SubscribeGroup
+func (c *TCP) SubscribeGroupExpr(group, expr, filter string) error {
+
+	if group == "" {
+		return fmt.Errorf("Unable to subscribe - missing group")
+	}
+
+	if expr == "" {
+		return fmt.Errorf("Unable to subscribe - missing expression")
+	}
+
+	_, err := c.request(core.Message{Command: "subscribe.expr", Group: group, Data: expr, Filter: filter})
+	return err
+}
+
+// UnsubscribeGroup leaves the consumer group; the messages the client hasn't
+// acked are redelivered to other members
+func (c *TCP) UnsubscribeGroup(group string) error {
+
+	if group == "" {
+		return fmt.Errorf("Unable to unsubscribe - missing group")
+	}
+
+	_, err := c.request(core.Message{Command: "unsubscribe", Group: group})
+	return err
+}
+
+// Ack acks a message delivered by a consumer group, so it isn't redelivered
+func (c *TCP) Ack(msg core.Message) error {
+
+	if msg.Group == "" {
+		return fmt.Errorf("Unable to ack - message wasn't delivered by a group")
+	}
+
+	_, err := c.request(core.Message{Command: "ack", Group: msg.Group, ID: msg.ID})
+	return err
+}
+
+// unixNano returns [t] in unix nanoseconds, or 0 if it's zero
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
 }
 
 // Publish sends a message to the core server to be published to all subscribed
-// clients
+// clients, waiting for it to ack; returning its error if it refused, or nil
 func (c *TCP) Publish(tags []string, data string) error {
 
 	if len(tags) == 0 {
@@ -128,43 +571,286 @@ func (c *TCP) Publish(tags []string, data string) error {
 		return fmt.Errorf("Unable to publish - missing data")
 	}
 
-	return c.encoder.Encode(&core.Message{Command: "publish", Tags: tags, Data: data})
+	_, err := c.request(core.Message{Command: "publish", Tags: tags, Data: data})
+	return err
+}
+
+// PublishMessage sends a message (its tags, data and headers) to the core server
+// to be published to all subscribed clients; the server assigns its ID, Timestamp
+// and Publisher, and the ID and Timestamp are returned in the server's ack
+func (c *TCP) PublishMessage(msg core.Message) (core.Message, error) {
+
+	if len(msg.Tags) == 0 {
+		return core.Message{}, fmt.Errorf("Unable to publish - missing tags")
+	}
+
+	if msg.Data == "" {
+		return core.Message{}, fmt.Errorf("Unable to publish - missing data")
+	}
+
+	msg.Command = "publish"
+	return c.request(msg)
+}
+
+// Request publishes a request to [tags], returning the first reply to it; or an
+// error if nobody replies within [timeout]. Whoever it's sent to replies with
+// Reply
+func (c *TCP) Request(tags []string, data string, timeout time.Duration) (core.Message, error) {
+
+	if len(tags) == 0 {
+		return core.Message{}, fmt.Errorf("Unable to request - missing tags")
+	}
+
+	if timeout <= 0 {
+		return core.Message{}, fmt.Errorf("Unable to request - missing timeout")
+	}
+
+	// the server times the request out; waiting a little longer lets it say so
+	return c.requestWithin(core.Message{Command: "request", Tags: tags, Data: data, TTL: timeout.String()}, timeout+c.timeout)
+}
+
+// Reply publishes [data] as the reply to a request received on Messages
+func (c *TCP) Reply(req core.Message, data string) error {
+
+	to := req.Headers[core.ReplyTo]
+	if to == "" {
+		return fmt.Errorf("Unable to reply - the message isn't a request")
+	}
+
+	_, err := c.request(core.Message{Command: "publish", Tags: []string{to}, Data: data})
+	return err
+}
+
+// PublishTTL publishes a message like Publish, that expires after [ttl]; the
+// server drops it rather than deliver it any later
+func (c *TCP) PublishTTL(tags []string, data string, ttl time.Duration) error {
+	_, err := c.PublishMessage(core.Message{Tags: tags, Data: data, TTL: ttl.String()})
+	return err
+}
+
+// PublishRetained publishes a message like Publish, and has the server keep it as
+// the last value of the tags; it's sent to everyone who subscribes to them later
+func (c *TCP) PublishRetained(tags []string, data string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to publish - missing tags")
+	}
+
+	if data == "" {
+		return fmt.Errorf("Unable to publish - missing data")
+	}
+
+	_, err := c.request(core.Message{Command: "publish", Tags: tags, Data: data, Retain: true})
+	return err
+}
+
+// ClearRetained has the server forget the retained message of the tags
+func (c *TCP) ClearRetained(tags []string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to clear - missing tags")
+	}
+
+	_, err := c.request(core.Message{Command: "publish", Tags: tags, Retain: true})
+	return err
 }
 
 // PublishAfter sends a message to the core server to be published to all subscribed
-// clients after a specified delay
+// clients after a specified delay; the server keeps it until then, so it's still
+// published if the client goes away
 func (c *TCP) PublishAfter(tags []string, data string, delay time.Duration) error {
-	go func() {
-		<-time.After(delay)
-		c.Publish(tags, data)
-	}()
-	return nil
+	_, err := c.ScheduleAfter(core.Message{Tags: tags, Data: data}, delay)
+	return err
+}
+
+// PublishAt sends a message to the core server to be published to all subscribed
+// clients at [at]
+func (c *TCP) PublishAt(tags []string, data string, at time.Time) error {
+	_, err := c.ScheduleAt(core.Message{Tags: tags, Data: data}, at)
+	return err
+}
+
+// ScheduleAfter sends a message (its tags, data and headers) to the core server
+// to be published after [delay]; the server's ack has the ID to cancel it with,
+// and its Timestamp is when it will be published
+func (c *TCP) ScheduleAfter(msg core.Message, delay time.Duration) (core.Message, error) {
+
+	if len(msg.Tags) == 0 {
+		return core.Message{}, fmt.Errorf("Unable to schedule - missing tags")
+	}
+
+	if msg.Data == "" {
+		return core.Message{}, fmt.Errorf("Unable to schedule - missing data")
+	}
+
+	msg.Command = "publishAfter"
+	msg.Delay = delay.String()
+	return c.request(msg)
 }
 
-// List requests a list from the server of the tags this client is subscribed to
-func (c *TCP) List() error {
-	return c.encoder.Encode(&core.Message{Command: "list"})
+// ScheduleAt sends a message (its tags, data and headers) to the core server to
+// be published at [at]; the server's ack has the ID to cancel it with
+func (c *TCP) ScheduleAt(msg core.Message, at time.Time) (core.Message, error) {
+
+	if len(msg.Tags) == 0 {
+		return core.Message{}, fmt.Errorf("Unable to schedule - missing tags")
+	}
+
+	if msg.Data == "" {
+		return core.Message{}, fmt.Errorf("Unable to schedule - missing data")
+	}
+
+	msg.Command = "publishAt"
+	msg.Timestamp = at.UnixNano()
+	return c.request(msg)
+}
+
+// ListScheduled returns the messages waiting on the server to be published, that
+// this client could have published itself; each Timestamp is when it will be
+func (c *TCP) ListScheduled() ([]core.Message, error) {
+	scheduled := []core.Message{}
+
+	msg, err := c.request(core.Message{Command: "schedule.list"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(msg.Data), &scheduled); err != nil {
+		return nil, fmt.Errorf("Failed to decode scheduled messages - %s", err.Error())
+	}
+
+	return scheduled, nil
+}
+
+// CancelScheduled has the server cancel the scheduled message with [id]
+func (c *TCP) CancelScheduled(id string) error {
+
+	if id == "" {
+		return fmt.Errorf("Unable to cancel - missing id")
+	}
+
+	_, err := c.request(core.Message{Command: "schedule.cancel", ID: id})
+	return err
+}
+
+// List returns the tags this client is subscribed to, as listed by the server
+func (c *TCP) List() (string, error) {
+	msg, err := c.request(core.Message{Command: "list"})
+	return msg.Data, err
 }
 
 // listall related
-// List requests a list from the server of the tags this client is subscribed to
-func (c *TCP) ListAll() error {
-	return c.encoder.Encode(&core.Message{Command: "listall"})
+// ListAll returns the tags every client is subscribed to, as listed by the server
+func (c *TCP) ListAll() (string, error) {
+	msg, err := c.request(core.Message{Command: "listall"})
+	return msg.Data, err
 }
 
 // who related
-// Who requests connection/subscriber stats from the server
-func (c *TCP) Who() error {
-	return c.encoder.Encode(&core.Message{Command: "who"})
+// Who returns connection/subscriber stats from the server
+func (c *TCP) Who() (string, error) {
+	msg, err := c.request(core.Message{Command: "who"})
+	return msg.Data, err
+}
+
+// Stats returns message delivery stats from the server
+func (c *TCP) Stats() (core.Stats, error) {
+	stats := core.Stats{}
+
+	msg, err := c.request(core.Message{Command: "stats"})
+	if err != nil {
+		return stats, err
+	}
+
+	if err := json.Unmarshal([]byte(msg.Data), &stats); err != nil {
+		return stats, fmt.Errorf("Failed to decode stats - %s", err.Error())
+	}
+
+	return stats, nil
 }
 
-// Close closes the client data channel and the connection to the server
+// AddToken has the server add a token, restricted by its ACL; or, given the
+// Identity of a client certificate instead, set the identity's ACL. The client
+// must be authenticated with the master token
+func (c *TCP) AddToken(token auth.Token) error {
+
+	if token.Token == "" && token.Identity == "" {
+		return fmt.Errorf("Unable to add token - missing token")
+	}
+
+	b, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("Unable to add token - %s", err.Error())
+	}
+
+	_, err = c.request(core.Message{Command: "token.add", Data: string(b)})
+	return err
+}
+
+// RemoveToken has the server remove a token; the client must be authenticated
+// with the master token
+func (c *TCP) RemoveToken(token string) error {
+
+	if token == "" {
+		return fmt.Errorf("Unable to remove token - missing token")
+	}
+
+	_, err := c.request(core.Message{Command: "token.remove", Data: token})
+	return err
+}
+
+// RemoveIdentity has the server remove the ACL of a client certificate identity,
+// leaving it unrestricted; the client must be authenticated with the master token
+func (c *TCP) RemoveIdentity(identity string) error {
+
+	if identity == "" {
+		return fmt.Errorf("Unable to remove identity - missing identity")
+	}
+
+	b, err := json.Marshal(auth.Token{Identity: identity})
+	if err != nil {
+		return fmt.Errorf("Unable to remove identity - %s", err.Error())
+	}
+
+	_, err = c.request(core.Message{Command: "token.remove", Data: string(b)})
+	return err
+}
+
+// ListTokens returns every token (and its ACL) from the server; the client must
+// be authenticated with the master token
+func (c *TCP) ListTokens() ([]auth.Token, error) {
+	tokens := []auth.Token{}
+
+	msg, err := c.request(core.Message{Command: "token.list"})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(msg.Data), &tokens); err != nil {
+		return nil, fmt.Errorf("Failed to decode tokens - %s", err.Error())
+	}
+
+	return tokens, nil
+}
+
+// Close closes the connection to the server, and stops the client reconnecting;
+// Messages is closed once what was received has been read
 func (c *TCP) Close() {
-	c.conn.Close()
-	// close(c.messages) // we don't close this in case there is a message waiting in the channel
+	c.finish()
+
+	c.connTex.Lock()
+	conn := c.conn
+	c.connTex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
 }
 
-// Messages ...
+// Messages returns the messages the client receives that aren't replies to its
+// requests; it's closed once the connection is lost and they've all been read.
+// Messages wait in an inbox until they're read, which only holds so many; see
+// WithInbox
 func (c *TCP) Messages() <-chan core.Message {
 	return c.messages
 }
@@ -1,11 +1,18 @@
 package clients_test
 
 import (
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/SteveWXT/pubsub/auth"
 	"github.com/SteveWXT/pubsub/clients"
+	"github.com/SteveWXT/pubsub/core"
 	"github.com/SteveWXT/pubsub/server"
 	"github.com/jcelliott/lumber"
 )
@@ -35,12 +42,8 @@ func TestTCPClientConnect(t *testing.T) {
 	defer client.Close()
 
 	if err := client.Ping(); err != nil {
-		t.Fatalf("ping failed")
+		t.Fatalf("ping failed - %s", err.Error())
 	}
-	if msg := <-client.Messages(); msg.Data != "pong" {
-		t.Fatalf("Unexpected data: Expecting 'pong' got %s", msg.Data)
-	}
-	client.Ping()
 }
 
 // TestBadTCPClientConnect tests to ensure a client can connect to a running server
@@ -57,12 +60,239 @@ func TestBadTCPClientConnect(t *testing.T) {
 	defer client.Close()
 
 	if err := client.Ping(); err != nil {
-		t.Fatalf("ping failed")
+		t.Fatalf("ping failed - %s", err.Error())
+	}
+}
+
+// TestTCPClientAuth tests to ensure a client can only connect with a valid token
+// when the server has an authenticator configured
+func TestTCPClientAuth(t *testing.T) {
+	if err := auth.Start("memory://?token=secret"); err != nil {
+		t.Fatalf("Failed to start authenticator - %s", err.Error())
+	}
+	defer auth.SetDefault(nil)
+
+	if _, err := clients.New(testAddr); err == nil {
+		t.Fatalf("Client connected without a token")
+	}
+	if _, err := clients.New(testAddr, clients.WithToken("bogus")); err == nil {
+		t.Fatalf("Client connected with a bad token")
+	}
+
+	client, err := clients.New(testAddr, clients.WithToken("secret"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("ping failed - %s", err.Error())
+	}
+
+	// a token restricted to publishing can't subscribe
+	auth.Default().SetACL("secret", &auth.ACL{Publish: [][]string{{"billing"}}})
+	if err := client.Subscribe([]string{"billing"}); err == nil {
+		t.Fatalf("Expected subscribe to be denied")
+	}
+
+	// and can only publish to what it's allowed
+	if err := client.Publish([]string{"orders"}, testMsg); err == nil {
+		t.Fatalf("Expected publish to be denied")
+	}
+	if err := client.Publish([]string{"billing"}, testMsg); err != nil {
+		t.Fatalf("publishing failed %s", err.Error())
+	}
+}
+
+// TestTCPClientExpr tests to ensure a client can subscribe to an expression, and
+// only receives what its ACL allows
+func TestTCPClientExpr(t *testing.T) {
+	if err := auth.Start("memory://?token=secret"); err != nil {
+		t.Fatalf("Failed to start authenticator - %s", err.Error())
+	}
+	defer auth.SetDefault(nil)
+	auth.Default().SetACL("secret", &auth.ACL{Subscribe: [][]string{{"orders"}}})
+
+	auth.MasterToken = "master"
+	defer func() { auth.MasterToken = "" }()
+
+	sender, err := clients.New(testAddr, clients.WithToken("master"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer sender.Close()
+
+	client, err := clients.New(testAddr, clients.WithToken("secret"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.SubscribeExpr("", ""); err == nil {
+		t.Fatalf("Subscription succeeded with missing expression!")
+	}
+	if err := client.SubscribeExpr("orders AND", ""); err == nil {
+		t.Fatalf("Expected malformed expression to fail")
+	}
+
+	if err := client.SubscribeExpr("(orders AND eu) OR refunds", ""); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// refunds matches the expression, but the token may only receive orders
+	sender.Publish([]string{"refunds"}, "denied")
+	sender.Publish([]string{"eu", "orders"}, testMsg)
+	if msg := <-client.Messages(); msg.Data != testMsg {
+		t.Fatalf("Unexpected data: Expecting '%s' got '%s'", testMsg, msg.Data)
+	}
+}
+
+// TestTCPClientFilter tests to ensure a client only receives messages whose data
+// matches its subscription's filter
+func TestTCPClientFilter(t *testing.T) {
+	sender, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer sender.Close()
+
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.SubscribeFiltered([]string{"alerts"}, "severity >>= 3"); err == nil {
+		t.Fatalf("Expected malformed filter to fail")
+	}
+
+	if err := client.SubscribeFiltered([]string{"alerts"}, "severity >= 3"); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	sender.Publish([]string{"alerts"}, `{"severity":1}`)
+	sender.Publish([]string{"alerts"}, `{"severity":5}`)
+	if msg := <-client.Messages(); msg.Data != `{"severity":5}` {
+		t.Fatalf("Unexpected data: Expecting '{\"severity\":5}' got '%s'", msg.Data)
+	}
+}
+
+// TestTCPClientHeaders tests to ensure published messages arrive with their
+// headers and the id and timestamp the server assigned them
+func TestTCPClientHeaders(t *testing.T) {
+	sender, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer sender.Close()
+
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	client.Subscribe([]string{"headers"})
+	time.Sleep(100 * time.Millisecond)
+
+	published, err := sender.PublishMessage(core.Message{Tags: []string{"headers"}, Data: testMsg, Headers: map[string]string{"trace": "abc"}})
+	if err != nil {
+		t.Fatalf("publishing failed %s", err.Error())
+	}
+
+	msg := <-client.Messages()
+	if msg.Data != testMsg || msg.Headers["trace"] != "abc" || msg.ID == "" || msg.Timestamp == 0 {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+
+	// the ack carries the id and timestamp the message was published with
+	if published.ID != msg.ID || published.Timestamp != msg.Timestamp {
+		t.Fatalf("Unexpected ack - %#v", published)
+	}
+}
+
+// TestTCPClientTokens tests to ensure only a client authenticated with the master
+// token can manage tokens
+func TestTCPClientTokens(t *testing.T) {
+	if err := auth.Start("memory://?token=user"); err != nil {
+		t.Fatalf("Failed to start authenticator - %s", err.Error())
+	}
+	auth.MasterToken = "master"
+	defer func() { auth.SetDefault(nil); auth.MasterToken = "" }()
+
+	user, err := clients.New(testAddr, clients.WithToken("user"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer user.Close()
+
+	if err := user.AddToken(auth.Token{Token: "new"}); err == nil || err.Error() != auth.ErrNotAdmin.Error() {
+		t.Fatalf("Expected non-admin to be forbidden, got '%v'", err)
+	}
+
+	admin, err := clients.New(testAddr, clients.WithToken("master"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer admin.Close()
+
+	if err := admin.AddToken(auth.Token{Token: ""}); err == nil {
+		t.Fatalf("Added empty token")
+	}
+	if err := admin.AddToken(auth.Token{Token: "new", ACL: &auth.ACL{Subscribe: [][]string{{"a"}}}}); err != nil {
+		t.Fatalf("add token failed %s", err.Error())
+	}
+
+	tokens, err := admin.ListTokens()
+	if err != nil {
+		t.Fatalf("list tokens failed %s", err.Error())
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("Unexpected tokens - %#v", tokens)
+	}
+
+	// the new token can connect until it's removed, and only sees subscriptions
+	// its ACL allows it
+	if err := admin.Subscribe([]string{"b"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	client, err := clients.New(testAddr, clients.WithToken("new"))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	if err := client.Subscribe([]string{"a"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	if list, err := client.ListAll(); err != nil || list != "a" {
+		t.Fatalf("Unexpected listall - '%v' '%s'", err, list)
+	}
+	client.Close()
+
+	if err := admin.RemoveToken("new"); err != nil {
+		t.Fatalf("remove token failed %s", err.Error())
+	}
+
+	// client certificate identities have their ACLs managed alongside tokens
+	if err := admin.AddToken(auth.Token{Identity: "service"}); err == nil {
+		t.Fatalf("Added identity without an ACL")
+	}
+	if err := admin.AddToken(auth.Token{Identity: "service", ACL: &auth.ACL{Subscribe: [][]string{{"a"}}}}); err != nil {
+		t.Fatalf("add identity failed %s", err.Error())
+	}
+	if tokens, err := admin.ListTokens(); err != nil || len(tokens) != 2 {
+		t.Fatalf("Unexpected tokens - %v %#v", err, tokens)
 	}
-	if msg := <-client.Messages(); msg.Data != "pong" {
-		t.Fatalf("Unexpected data: Expecting 'pong' got %s", msg.Data)
+	if err := admin.RemoveIdentity("service"); err != nil {
+		t.Fatalf("remove identity failed %s", err.Error())
+	}
+	if err := admin.RemoveIdentity("service"); err == nil || err.Error() != auth.ErrIdentityNotFound.Error() {
+		t.Fatalf("Expected removing a removed identity to fail, got '%v'", err)
+	}
+	if _, err := clients.New(testAddr, clients.WithToken("new")); err == nil {
+		t.Fatalf("Client connected with a removed token")
 	}
-	client.Ping()
 }
 
 // TestTCPClient tests to ensure a client can run all of its expected commands;
@@ -88,11 +318,8 @@ func TestTCPClient(t *testing.T) {
 	}
 
 	// test ability to list (subscriptions)
-	if err := client.List(); err != nil {
-		t.Fatalf("listing subscriptions failed %s", err.Error())
-	}
-	if msg := <-client.Messages(); msg.Data == "\"a\"" {
-		t.Fatalf("Failed to 'list' - '%s' '%#v'", msg.Error, msg.Data)
+	if list, err := client.List(); err != nil || list != "a" {
+		t.Fatalf("Failed to 'list' - '%v' '%s'", err, list)
 	}
 
 	// test publish
@@ -121,10 +348,564 @@ func TestTCPClient(t *testing.T) {
 	}
 
 	// test ability to list (no subscriptions)
-	if err := client.List(); err != nil {
-		t.Fatalf("listing subscriptions failed %s", err.Error())
+	if list, err := client.List(); err != nil || list != "" {
+		t.Fatalf("Failed to 'list' - '%v' '%s'", err, list)
+	}
+}
+
+// TestTCPClientRequests tests to ensure requests sent back-to-back each get their
+// own reply, while published messages keep arriving on Messages
+func TestTCPClientRequests(t *testing.T) {
+	sender, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer sender.Close()
+
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	client.Subscribe([]string{"requests"})
+	time.Sleep(100 * time.Millisecond)
+
+	// published messages are interleaved with the replies
+	go func() {
+		for i := 0; i < 10; i++ {
+			sender.Publish([]string{"requests"}, testMsg)
+		}
+	}()
+	received := make(chan int)
+	go func() {
+		count := 0
+		for msg := range client.Messages() {
+			if msg.Data != testMsg || msg.RequestID != "" {
+				t.Errorf("Unexpected message - %#v", msg)
+			}
+			if count++; count == 10 {
+				break
+			}
+		}
+		received <- count
+	}()
+
+	for i := 0; i < 10; i++ {
+		if err := client.Ping(); err != nil {
+			t.Fatalf("ping failed - %s", err.Error())
+		}
+		if list, err := client.List(); err != nil || list != "requests" {
+			t.Fatalf("Failed to 'list' - '%v' '%s'", err, list)
+		}
+		if who, err := client.Who(); err != nil || !strings.Contains(who, "Subscribers connected") {
+			t.Fatalf("Failed to 'who' - '%v' '%s'", err, who)
+		}
+	}
+
+	select {
+	case count := <-received:
+		if count != 10 {
+			t.Fatalf("Expected 10 messages, received %d", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting messages, received none!")
+	}
+
+	// errors are returned to the request that caused them
+	if _, err := client.Stats(); err != nil {
+		t.Fatalf("stats failed - %s", err.Error())
+	}
+	if err := client.AddToken(auth.Token{Token: "new"}); err == nil {
+		t.Fatalf("Expected non-admin to be forbidden")
+	}
+}
+
+// TestTCPClientReplay tests to ensure a client can replay the messages it missed
+// from the server's message log
+func TestTCPClientReplay(t *testing.T) {
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.SubscribeReplay([]string{"replay"}, "", 1, time.Time{}); err == nil {
+		t.Fatalf("Replayed without a message log")
+	}
+
+	log, err := core.OpenLog(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
 	}
-	if msg := <-client.Messages(); msg.Data != "" {
-		t.Fatalf("Failed to 'list' - %s", msg.Error)
+	core.DefaultLog = log
+	defer func() { core.DefaultLog = nil; log.Close() }()
+
+	// published before the client subscribed
+	for _, data := range []string{"a", "b", "c"} {
+		core.Publish([]string{"replay"}, data)
 	}
+
+	if err := client.SubscribeReplay([]string{"replay"}, "", 2, time.Time{}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	core.Publish([]string{"replay"}, "d")
+
+	for i, data := range []string{"b", "c", "d"} {
+		if msg := <-client.Messages(); msg.Data != data || msg.Offset != uint64(i+2) {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	}
+}
+
+// TestTCPClientRetain tests to ensure a client gets a retained message as soon
+// as it subscribes, until it's cleared
+func TestTCPClientRetain(t *testing.T) {
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.PublishRetained([]string{"config"}, testMsg); err != nil {
+		t.Fatalf("publishing failed %s", err.Error())
+	}
+	defer client.ClearRetained([]string{"config"})
+
+	if err := client.Subscribe([]string{"config"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	if msg := <-client.Messages(); msg.Data != testMsg || !msg.Retain {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+
+	if err := client.ClearRetained([]string{"config"}); err != nil {
+		t.Fatalf("clearing failed %s", err.Error())
+	}
+	if stats, err := client.Stats(); err != nil || stats.Retained != 0 {
+		t.Fatalf("Unexpected stats - %v %#v", err, stats)
+	}
+}
+
+// TestTCPClientGroup tests that members of a consumer group share its messages,
+// and that acking them works
+func TestTCPClientGroup(t *testing.T) {
+	publisher, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer publisher.Close()
+
+	members := []*clients.TCP{}
+	for i := 0; i < 2; i++ {
+		member, err := clients.New(testAddr)
+		if err != nil {
+			t.Fatalf("Client failed to connect - %s", err.Error())
+		}
+		defer member.Close()
+
+		if err := member.SubscribeGroup("workers", []string{"jobs"}, ""); err != nil {
+			t.Fatalf("client subscriptions failed %s", err.Error())
+		}
+		members = append(members, member)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := publisher.Publish([]string{"jobs"}, testMsg); err != nil {
+			t.Fatalf("publishing failed %s", err.Error())
+		}
+	}
+
+	// each member gets half, and acks them
+	for _, member := range members {
+		for i := 0; i < 2; i++ {
+			select {
+			case msg := <-member.Messages():
+				if msg.Group != "workers" {
+					t.Fatalf("Unexpected message - %#v", msg)
+				}
+				if err := member.Ack(msg); err != nil {
+					t.Fatalf("acking failed %s", err.Error())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expecting message, received none!")
+			}
+		}
+	}
+
+	if err := members[0].Ack(core.Message{Group: "workers", ID: "unknown"}); err == nil {
+		t.Fatalf("Expected acking an unknown message to fail")
+	}
+	if stats, err := publisher.Stats(); err != nil || stats.Unacked != 0 {
+		t.Fatalf("Unexpected stats - %v %#v", err, stats)
+	}
+}
+
+// TestTCPClientSchedule tests that the server publishes scheduled messages, and
+// lists and cancels them
+func TestTCPClientSchedule(t *testing.T) {
+	publisher, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+
+	subscriber, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	if err := subscriber.Subscribe([]string{"scheduled"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+
+	soon, err := publisher.ScheduleAfter(core.Message{Tags: []string{"scheduled"}, Data: "soon"}, 100*time.Millisecond)
+	if err != nil || soon.ID == "" {
+		t.Fatalf("scheduling failed %v %#v", err, soon)
+	}
+	later, err := publisher.ScheduleAt(core.Message{Tags: []string{"scheduled"}, Data: "later"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("scheduling failed %s", err.Error())
+	}
+
+	if scheduled, err := publisher.ListScheduled(); err != nil || len(scheduled) < 2 {
+		t.Fatalf("Unexpected scheduled messages - %v %#v", err, scheduled)
+	}
+	if err := publisher.CancelScheduled(later.ID); err != nil {
+		t.Fatalf("cancelling failed %s", err.Error())
+	}
+	if err := publisher.CancelScheduled(later.ID); err == nil {
+		t.Fatalf("Expected cancelling twice to fail")
+	}
+
+	// the server publishes it, even though the publisher has gone
+	publisher.Close()
+	select {
+	case msg := <-subscriber.Messages():
+		if msg.ID != soon.ID || msg.Data != "soon" {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+}
+
+// TestTCPClientTTL tests that the server drops messages that expired before a
+// subscriber got them
+func TestTCPClientTTL(t *testing.T) {
+	client, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.PublishTTL([]string{"presence"}, testMsg, 0); err == nil {
+		t.Fatalf("Expected publishing with no ttl to fail")
+	}
+
+	published, err := client.PublishMessage(core.Message{Tags: []string{"presence"}, Data: testMsg, TTL: "50ms", Retain: true})
+	if err != nil || published.Expires <= published.Timestamp {
+		t.Fatalf("publishing failed %v %#v", err, published)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the retained message has expired, so it isn't sent
+	if err := client.Subscribe([]string{"presence"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	select {
+	case msg := <-client.Messages():
+		t.Fatalf("Unexpected message - %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if stats, err := client.Stats(); err != nil || stats.Retained != 0 || stats.Expired == 0 {
+		t.Fatalf("Unexpected stats - %v %#v", err, stats)
+	}
+}
+
+// TestTCPClientRequest tests that a request gets the reply to it, or times out
+func TestTCPClientRequest(t *testing.T) {
+	requester, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer requester.Close()
+
+	responder, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer responder.Close()
+
+	if err := responder.Subscribe([]string{"echo"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	go func() {
+		for req := range responder.Messages() {
+			responder.Reply(req, req.Data)
+		}
+	}()
+
+	reply, err := requester.Request([]string{"echo"}, testMsg, time.Second)
+	if err != nil || reply.Data != testMsg {
+		t.Fatalf("Unexpected reply - %v %#v", err, reply)
+	}
+
+	if _, err := requester.Request([]string{"nobody"}, testMsg, 50*time.Millisecond); err == nil || err.Error() != core.ErrRequestTimeout.Error() {
+		t.Fatalf("Expected the request to time out - %v", err)
+	}
+
+	// reply tags can't be listened in on, or published to without a request
+	if err := responder.Subscribe([]string{"_reply.*"}); err == nil {
+		t.Fatalf("Expected subscribing to reply tags to fail")
+	}
+	if err := responder.Publish([]string{"_reply.0123"}, testMsg); err == nil {
+		t.Fatalf("Expected publishing to a reply tag nobody's waiting on to fail")
+	}
+}
+
+// TestTCPClientInbox tests that a client reading its messages too slowly keeps
+// only as many as its inbox holds
+func TestTCPClientInbox(t *testing.T) {
+	if _, err := clients.New(testAddr, clients.WithInbox(0, core.DropOldest)); err == nil {
+		t.Fatalf("Expected an empty inbox to be refused")
+	}
+	if _, err := clients.New(testAddr, clients.WithInbox(2, "drop-everything")); err == nil {
+		t.Fatalf("Expected an unknown overflow policy to be refused")
+	}
+
+	client, err := clients.New(testAddr, clients.WithInbox(2, core.DropOldest))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.Subscribe([]string{"inbox"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	for i := 1; i <= 10; i++ {
+		if err := core.Publish([]string{"inbox"}, fmt.Sprint(i)); err != nil {
+			t.Fatalf("publishing failed %s", err.Error())
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// one may be waiting on the channel, besides the two in the inbox
+	received := []string{}
+	for done := false; !done; {
+		select {
+		case msg := <-client.Messages():
+			received = append(received, msg.Data)
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if len(received) < 2 || len(received) > 3 || received[len(received)-1] != "10" {
+		t.Fatalf("Unexpected messages - %v", received)
+	}
+	if client.Dropped() < 7 {
+		t.Fatalf("Unexpected drops - %d", client.Dropped())
+	}
+}
+
+// TestTCPClientReconnectOptions tests that a backoff that could never wait, or
+// whose max is under its min, is refused
+func TestTCPClientReconnectOptions(t *testing.T) {
+	for _, backoff := range [][2]time.Duration{{0, time.Second}, {-time.Second, time.Second}, {time.Second, 0}, {time.Minute, time.Second}} {
+		if _, err := clients.New(testAddr, clients.WithReconnect(backoff[0], backoff[1])); err == nil {
+			t.Fatalf("Expected backoff %s to %s to be refused", backoff[0], backoff[1])
+		}
+	}
+}
+
+// TestTCPClientReconnect tests that a client that reconnects makes its
+// subscriptions again, and publishes what was published while it was gone
+func TestTCPClientReconnect(t *testing.T) {
+	r := newRelay(t)
+	defer r.Close()
+
+	client, err := clients.New(r.Addr(), clients.WithReconnect(10*time.Millisecond, 50*time.Millisecond), clients.WithPublishBuffer(1))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	observer, err := clients.New(testAddr)
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer observer.Close()
+
+	if err := client.Subscribe([]string{"reconnect"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	if err := observer.Subscribe([]string{"kept"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+
+	// tags are a set, so unsubscribing from them in another order still counts
+	if err := client.Subscribe([]string{"gone-a", "gone-b"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+	if err := client.Unsubscribe([]string{"gone-b", "gone-a"}); err != nil {
+		t.Fatalf("client unsubscriptions failed %s", err.Error())
+	}
+
+	r.Down(true)
+	waitState(client, clients.Disconnected, t)
+
+	// one publish is kept for later, the rest are refused
+	if err := client.Publish([]string{"kept"}, testMsg); err != clients.ErrBuffered {
+		t.Fatalf("Expected publishing to be buffered - %v", err)
+	}
+	if err := client.Publish([]string{"kept"}, testMsg); err != clients.ErrDisconnected {
+		t.Fatalf("Expected publishing to fail - %v", err)
+	}
+	if err := client.Ping(); err != clients.ErrDisconnected {
+		t.Fatalf("Expected ping to fail - %v", err)
+	}
+
+	waitState(client, clients.Reconnecting, t)
+	r.Down(false)
+	waitState(client, clients.Connected, t)
+
+	select {
+	case msg := <-observer.Messages():
+		if msg.Data != testMsg {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting kept message, received none!")
+	}
+
+	if err := observer.Publish([]string{"reconnect"}, testMsg); err != nil {
+		t.Fatalf("publishing failed %s", err.Error())
+	}
+	select {
+	case msg := <-client.Messages():
+		if msg.Data != testMsg {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message after resubscribing, received none!")
+	}
+
+	if list, err := client.List(); err != nil || list != "reconnect" {
+		t.Fatalf("Unexpected subscriptions after resubscribing - '%v' '%s'", err, list)
+	}
+
+	client.Close()
+	waitState(client, clients.Closed, t)
+}
+
+// TestTCPClientDisconnect tests that a client that doesn't reconnect is closed
+// when its connection is lost
+func TestTCPClientDisconnect(t *testing.T) {
+	r := newRelay(t)
+	defer r.Close()
+
+	client, err := clients.New(r.Addr())
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	r.Down(true)
+	waitState(client, clients.Disconnected, t)
+	waitState(client, clients.Closed, t)
+
+	if _, ok := <-client.Messages(); ok {
+		t.Fatalf("Expected messages to be closed")
+	}
+	if err := client.Ping(); err != clients.ErrDisconnected {
+		t.Fatalf("Expected ping to fail - %v", err)
+	}
+}
+
+// waitState waits for the client's connection to reach [state], skipping the
+// states it passes through on the way
+func waitState(client *clients.TCP, state clients.State, t *testing.T) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-client.States():
+			if event.State == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expecting state %s, never reached", state)
+		}
+	}
+}
+
+// relay forwards connections to the test server, and cuts them off while down
+type relay struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+	down  bool
+}
+
+// newRelay starts a relay listening on a free port
+func newRelay(t *testing.T) *relay {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start relay - %s", err.Error())
+	}
+
+	r := &relay{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			if r.down {
+				conn.Close()
+				r.mu.Unlock()
+				continue
+			}
+			server, err := net.Dial("tcp", testAddr)
+			if err != nil {
+				conn.Close()
+				r.mu.Unlock()
+				continue
+			}
+			r.conns = append(r.conns, conn, server)
+			r.mu.Unlock()
+
+			go io.Copy(server, conn)
+			go io.Copy(conn, server)
+		}
+	}()
+
+	return r
+}
+
+// Addr is the address clients connect to the relay on
+func (r *relay) Addr() string {
+	return r.ln.Addr().String()
+}
+
+// Down cuts off the relay's connections, and refuses new ones, until it's up
+func (r *relay) Down(down bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.down = down
+	if down {
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+		r.conns = nil
+	}
+}
+
+// Close stops the relay, and cuts off its connections
+func (r *relay) Close() {
+	r.ln.Close()
+	r.Down(true)
 }
@@ -0,0 +1,293 @@
+package clients
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/SteveWXT/pubsub/core"
+)
+
+// State is the state of a client's connection to the server
+type State int
+
+const (
+	// Connected is a client that's connected (or reconnected, and resubscribed)
+	Connected State = iota
+	// Disconnected is a client that lost its connection; one that reconnects
+	// starts Reconnecting
+	Disconnected
+	// Reconnecting is a client trying to connect again
+	Reconnecting
+	// Closed is a client that's done with; it was closed, or lost its connection
+	// without reconnecting
+	Closed
+)
+
+// String returns the name of the state
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateEvent is a change in the state of a client's connection
+type StateEvent struct {
+	State   State
+	Attempt int   // the attempt a client is Reconnecting on, from 1
+	Err     error // why a client was Disconnected, or failed to resubscribe once Connected
+}
+
+// stateBuffer is how many state events wait to be read before more are dropped
+const stateBuffer = 16
+
+var (
+	// ErrDisconnected is returned by requests made while a client is disconnected;
+	// but for publishes when it has room to buffer them
+	ErrDisconnected = fmt.Errorf("Not connected to the server")
+
+	// ErrBuffered is returned by a publish made while a client is disconnected,
+	// that's kept to be published once it reconnects; unlike a nil error, the
+	// server hasn't acked it, and it's lost if the client closes first
+	ErrBuffered = fmt.Errorf("Not connected to the server - publish buffered until reconnected")
+)
+
+// WithReconnect has the client reconnect when its connection is lost, waiting
+// [min] before the first attempt and twice as long (up to [max]) before each
+// one after, less a random jitter of up to half. Once it's reconnected, the
+// subscriptions it had are made again (log replays and retained messages
+// aside); requests made meanwhile fail with ErrDisconnected. [min] has to be
+// positive, and [max] no less than it
+func WithReconnect(min, max time.Duration) Option {
+	return func(c *TCP) {
+		if min <= 0 || max < min {
+			c.optionErr = fmt.Errorf("Bad reconnect backoff %s to %s - expecting a positive min no greater than max", min, max)
+			return
+		}
+		c.backoffMin, c.backoffMax = min, max
+	}
+}
+
+// WithPublishBuffer has a client that reconnects keep up to [size] messages
+// published while it's disconnected, and publish them once it's reconnected;
+// those publishes return ErrBuffered. Once it has [size] the rest fail with
+// ErrDisconnected, as they all do without a buffer
+func WithPublishBuffer(size int) Option {
+	return func(c *TCP) {
+		c.bufferSize = size
+	}
+}
+
+// States returns the changes in the state of the client's connection; if they
+// aren't read, the latest are dropped once a few are waiting
+func (c *TCP) States() <-chan StateEvent {
+	return c.states
+}
+
+// reconnects returns whether the client reconnects when its connection is lost
+func (c *TCP) reconnects() bool {
+	return c.backoffMin > 0
+}
+
+// emit sends a state event without blocking
+func (c *TCP) emit(event StateEvent) {
+	select {
+	case c.states <- event:
+	default:
+		lumber.Trace("[pubsub client] Dropped state event - %#v", event)
+	}
+}
+
+// lost handles losing the connection that's [done]; the client reconnects, or
+// it's closed
+func (c *TCP) lost(done chan struct{}, err error) {
+	c.connTex.Lock()
+	c.connected = false
+	c.connTex.Unlock()
+	close(done)
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	c.emit(StateEvent{State: Disconnected, Err: err})
+
+	if !c.reconnects() {
+		c.finish()
+		return
+	}
+
+	go c.reconnect()
+}
+
+// finish closes the client for good
+func (c *TCP) finish() {
+	c.close.Do(func() {
+		close(c.closed)
+		c.emit(StateEvent{State: Closed})
+	})
+}
+
+// reconnect connects again, backing off between attempts until one succeeds or
+// the client is closed; then it makes its subscriptions again, and sends the
+// publishes it kept
+func (c *TCP) reconnect() {
+	delay := time.Duration(0)
+	for attempt := 1; ; attempt++ {
+		delay = c.backoff(delay)
+
+		select {
+		case <-time.After(jitter(delay)):
+		case <-c.closed:
+			return
+		}
+
+		c.emit(StateEvent{State: Reconnecting, Attempt: attempt})
+		if err := c.connect(); err != nil {
+			lumber.Debug("[pubsub client] Failed to reconnect - %s", err.Error())
+			continue
+		}
+
+		// closed while it was connecting
+		select {
+		case <-c.closed:
+			c.Close()
+			return
+		default:
+		}
+
+		break
+	}
+
+	c.connTex.Lock()
+	subscriptions := append([]core.Message{}, c.subscriptions...)
+	encoder, done := c.encoder, c.done
+	c.connTex.Unlock()
+
+	// if the connection is lost again meanwhile, the next reconnect picks up from
+	// the start
+	var failed error
+	for _, msg := range subscriptions {
+		if _, err := c.send(msg, encoder, done, c.timeout); err != nil {
+			if isDone(done) {
+				return
+			}
+			lumber.Error("[pubsub client] Failed to resubscribe - %s", err.Error())
+			failed = fmt.Errorf("Failed to resubscribe - %s", err.Error())
+		}
+	}
+
+	// publishes kept meanwhile are sent in order, ahead of any made after
+	for {
+		c.connTex.Lock()
+		if isDone(done) {
+			c.connTex.Unlock()
+			return
+		}
+		if len(c.buffered) == 0 {
+			c.buffered = nil
+			c.connected = true
+			c.connTex.Unlock()
+			break
+		}
+		msg := c.buffered[0]
+		c.buffered = c.buffered[1:]
+		c.connTex.Unlock()
+
+		if _, err := c.send(msg, encoder, done, c.timeout); err != nil {
+			if isDone(done) {
+				c.connTex.Lock()
+				c.buffered = append([]core.Message{msg}, c.buffered...)
+				c.connTex.Unlock()
+				return
+			}
+			lumber.Error("[pubsub client] Failed to publish kept message - %s", err.Error())
+		}
+	}
+
+	c.emit(StateEvent{State: Connected, Err: failed})
+}
+
+// isDone returns whether the connection that's [done] was lost
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns how long to wait before the reconnect attempt after one that
+// waited [last]; backoffMin for the first, then twice as long up to backoffMax
+func (c *TCP) backoff(last time.Duration) time.Duration {
+	switch {
+	case last <= 0:
+		return c.backoffMin
+	case last > c.backoffMax/2:
+		return c.backoffMax
+	}
+
+	return last * 2
+}
+
+// jitter takes a random jitter of up to half off [delay], so clients that lost
+// their connections together don't all reconnect together
+func jitter(delay time.Duration) time.Duration {
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// remember keeps track of the subscriptions the client makes, and forgets those
+// it unsubscribes from, so they can be made again if it reconnects
+func (c *TCP) remember(msg core.Message) {
+	switch msg.Command {
+	case "subscribe", "subscribe.expr", "unsubscribe", "unsubscribe.expr":
+	default:
+		return
+	}
+
+	c.connTex.Lock()
+	defer c.connTex.Unlock()
+
+	// a subscription made again is made as it was, not replayed
+	msg.RequestID, msg.Offset, msg.Timestamp = "", 0, 0
+
+	key := subscriptionKey(msg)
+	kept := c.subscriptions[:0]
+	for _, sub := range c.subscriptions {
+		switch {
+		case subscriptionKey(sub) == key:
+		case strings.HasPrefix(msg.Command, "un") && msg.Group != "" && sub.Group == msg.Group:
+		default:
+			kept = append(kept, sub)
+		}
+	}
+	c.subscriptions = kept
+
+	if strings.HasPrefix(msg.Command, "subscribe") {
+		c.subscriptions = append(c.subscriptions, msg)
+	}
+}
+
+// subscriptionKey identifies a subscription, whether subscribing or unsubscribing;
+// tags are a set, so they're sorted first
+func subscriptionKey(msg core.Message) string {
+	tags := append([]string{}, msg.Tags...)
+	sort.Strings(tags)
+
+	return strings.Join([]string{strings.TrimPrefix(msg.Command, "un"), msg.Group, strings.Join(tags, ","), msg.Filter, msg.Data}, "\x00")
+}
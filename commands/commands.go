@@ -2,9 +2,15 @@
 package commands
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
 
+	"github.com/SteveWXT/pubsub/auth"
+	"github.com/SteveWXT/pubsub/clients"
+	"github.com/SteveWXT/pubsub/core"
 	"github.com/SteveWXT/pubsub/server"
 	"github.com/jcelliott/lumber"
 
@@ -13,8 +19,15 @@ import (
 )
 
 var (
-	host = "127.0.0.1:1445" // host clients will connect to
-	tags []string           // tags to publish and [un]subscribe to/from
+	host  = "127.0.0.1:1445" // host clients will connect to
+	tags  []string           // tags to publish and [un]subscribe to/from
+	token string             // token clients will authenticate with
+
+	useTLS      bool   // whether clients connect over tls
+	tlsCA       string // CA file clients verify the server with
+	tlsInsecure bool   // whether clients skip verifying the server (development only)
+	clientCert  string // certificate file clients identify themselves with
+	clientKey   string // key file for the client certificate
 
 	config   string // location of the config file
 	showVers bool   // whether to show version info and exit or not
@@ -80,6 +93,55 @@ func start(ccmd *cobra.Command, args []string) error {
 	lumber.Prefix("[pubsub]")
 	lumber.Level(lumber.LvlInt(viper.GetString("log-level")))
 
+	// a master token needs somewhere to store the tokens it manages
+	auth.MasterToken = viper.GetString("master-token")
+	authenticator := viper.GetString("authenticator")
+	if authenticator == "" && auth.MasterToken != "" {
+		authenticator = "memory://"
+	}
+
+	if err := auth.Start(authenticator); err != nil {
+		return fmt.Errorf("Failed to start authenticator - %s", err.Error())
+	}
+
+	core.AckTimeout = viper.GetDuration("ack-timeout")
+	if core.AckTimeout <= 0 {
+		return fmt.Errorf("Bad ack timeout %s - consumer group members need some time to ack", core.AckTimeout)
+	}
+	core.QueueSize = viper.GetInt("queue-size")
+	if core.QueueSize < 1 {
+		return fmt.Errorf("Bad queue size %d - a subscriber's queue needs room for at least 1 message", core.QueueSize)
+	}
+	core.OverflowPolicy = viper.GetString("overflow-policy")
+	if err := core.ValidOverflowPolicy(core.OverflowPolicy); err != nil {
+		return err
+	}
+
+	if dir := viper.GetString("message-log"); dir != "" {
+		log, err := core.OpenLog(dir, viper.GetInt64("message-log-segment-size"), viper.GetInt64("message-log-retention-size"), viper.GetDuration("message-log-retention-age"))
+		if err != nil {
+			return err
+		}
+		log.SyncWrites = viper.GetBool("message-log-sync")
+		core.DefaultLog = log
+	}
+
+	if path := viper.GetString("schedule-file"); path != "" {
+		if err := core.OpenSchedule(path); err != nil {
+			return err
+		}
+	}
+
+	if path := viper.GetString("group-file"); path != "" {
+		if err := core.OpenGroups(path); err != nil {
+			return err
+		}
+	}
+
+	server.TLSCert = viper.GetString("tls-cert")
+	server.TLSKey = viper.GetString("tls-key")
+	server.TLSClientCA = viper.GetString("tls-client-ca")
+
 	if err := server.Start(viper.GetStringSlice("listeners")); err != nil {
 		return fmt.Errorf("One or more servers failed to start - %s", err.Error())
 	}
@@ -87,14 +149,101 @@ func start(ccmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// newClient connects a new client to the host, authenticating with the token
+// if one was provided
+func newClient() (*clients.TCP, error) {
+	opts := []clients.Option{clients.WithToken(token)}
+
+	// any of the tls flags imply connecting over tls
+	if useTLS || tlsCA != "" || tlsInsecure || clientCert != "" {
+		config := &tls.Config{InsecureSkipVerify: tlsInsecure}
+
+		if clientCert != "" {
+			cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load client certificate - %s", err.Error())
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		if tlsCA != "" {
+			pem, err := ioutil.ReadFile(tlsCA)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read CA file - %s", err.Error())
+			}
+
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("Failed to parse CA file '%s'", tlsCA)
+			}
+		}
+
+		opts = append(opts, clients.WithTLS(config))
+	}
+
+	return clients.New(host, opts...)
+}
+
 func init() {
 
 	// persistent config flags
 	PubSubCmd.PersistentFlags().String("log-level", "INFO", "Output level of logs (TRACE, DEBUG, INFO, WARN, ERROR, FATAL)")
 	viper.BindPFlag("log-level", PubSubCmd.PersistentFlags().Lookup("log-level"))
 
+	// persistent client flags
+	PubSubCmd.PersistentFlags().BoolVar(&useTLS, "tls", useTLS, "Connect to the server over TLS")
+	PubSubCmd.PersistentFlags().StringVar(&tlsCA, "tls-ca", tlsCA, "CA file to verify the server's certificate with (implies --tls)")
+	PubSubCmd.PersistentFlags().BoolVar(&tlsInsecure, "tls-insecure", tlsInsecure, "Skip verifying the server's certificate; for development only (implies --tls)")
+	PubSubCmd.PersistentFlags().StringVar(&clientCert, "tls-client-cert", clientCert, "Certificate file to identify the client with, instead of a token (implies --tls)")
+	PubSubCmd.PersistentFlags().StringVar(&clientKey, "tls-client-key", clientKey, "Key file for the client certificate")
+
 	PubSubCmd.Flags().StringSlice("listeners", []string{"tcp://127.0.0.1:1445", "ws://127.0.0.1:8888"}, "A comma delimited list of servers to start")
-	viper.BindPFlag("listeners", PubSubCmd.Flags().Lookup("listeners")) // no reason to have "http://127.0.0.1:8080" too, it only has /ping
+	viper.BindPFlag("listeners", PubSubCmd.Flags().Lookup("listeners")) // add "http://127.0.0.1:8080" for the http api
+
+	PubSubCmd.Flags().String("authenticator", "", "Require clients to authenticate with a token stored by this authenticator (memory://?token=abc, file:///path/to/tokens.json)")
+	viper.BindPFlag("authenticator", PubSubCmd.Flags().Lookup("authenticator"))
+
+	PubSubCmd.Flags().String("master-token", "", "A token that authenticates admin clients, which may manage tokens (defaults the authenticator to memory://)")
+	viper.BindPFlag("master-token", PubSubCmd.Flags().Lookup("master-token"))
+
+	PubSubCmd.Flags().String("tls-cert", "", "Certificate file for tls://, wss:// and https:// listeners without a ?cert= of their own")
+	viper.BindPFlag("tls-cert", PubSubCmd.Flags().Lookup("tls-cert"))
+
+	PubSubCmd.Flags().String("tls-key", "", "Key file for tls://, wss:// and https:// listeners without a ?key= of their own")
+	viper.BindPFlag("tls-key", PubSubCmd.Flags().Lookup("tls-key"))
+
+	PubSubCmd.Flags().String("tls-client-ca", "", "CA file to verify client certificates with; verified clients are identified by their certificate instead of a token")
+	viper.BindPFlag("tls-client-ca", PubSubCmd.Flags().Lookup("tls-client-ca"))
+
+	PubSubCmd.Flags().Int("queue-size", core.QueueSize, "The most messages a subscriber can have waiting to be sent to it")
+	viper.BindPFlag("queue-size", PubSubCmd.Flags().Lookup("queue-size"))
+
+	PubSubCmd.Flags().String("overflow-policy", core.OverflowPolicy, "What happens to messages for a subscriber with a full queue (drop-oldest, drop-newest, disconnect)")
+	viper.BindPFlag("overflow-policy", PubSubCmd.Flags().Lookup("overflow-policy"))
+
+	PubSubCmd.Flags().Duration("ack-timeout", core.AckTimeout, "How long a consumer group member has to ack a message before it's redelivered")
+	viper.BindPFlag("ack-timeout", PubSubCmd.Flags().Lookup("ack-timeout"))
+
+	PubSubCmd.Flags().String("message-log", "", "Directory to log published messages to, so subscribers can replay them (--offset, --since)")
+	viper.BindPFlag("message-log", PubSubCmd.Flags().Lookup("message-log"))
+
+	PubSubCmd.Flags().Int64("message-log-segment-size", 64<<20, "The size, in bytes, a message log file grows to before a new one is started")
+	viper.BindPFlag("message-log-segment-size", PubSubCmd.Flags().Lookup("message-log-segment-size"))
+
+	PubSubCmd.Flags().Int64("message-log-retention-size", 0, "The size, in bytes, the message log is kept under by removing its oldest files (0 keeps everything)")
+	viper.BindPFlag("message-log-retention-size", PubSubCmd.Flags().Lookup("message-log-retention-size"))
+
+	PubSubCmd.Flags().Duration("message-log-retention-age", 0, "How long message log files are kept once they're no longer written to (0 keeps them forever)")
+	viper.BindPFlag("message-log-retention-age", PubSubCmd.Flags().Lookup("message-log-retention-age"))
+
+	PubSubCmd.Flags().Bool("message-log-sync", false, "Sync every message to disk before acking its publish, rather than each message log file once it's full")
+	viper.BindPFlag("message-log-sync", PubSubCmd.Flags().Lookup("message-log-sync"))
+
+	PubSubCmd.Flags().String("schedule-file", "", "File to save messages scheduled with publishAfter and publishAt to, so they survive a restart")
+	viper.BindPFlag("schedule-file", PubSubCmd.Flags().Lookup("schedule-file"))
+
+	PubSubCmd.Flags().String("group-file", "", "File to save the messages consumer groups are waiting on to, so they survive a restart")
+	viper.BindPFlag("group-file", PubSubCmd.Flags().Lookup("group-file"))
 
 	PubSubCmd.Flags().StringVar(&config, "config", config, "Path to config file")
 	viper.BindPFlag("config", PubSubCmd.Flags().Lookup("config"))
@@ -108,10 +257,14 @@ func init() {
 	PubSubCmd.AddCommand(pingCmd)
 	PubSubCmd.AddCommand(subscribeCmd)
 	PubSubCmd.AddCommand(publishCmd)
+	PubSubCmd.AddCommand(requestCmd)
+	PubSubCmd.AddCommand(tokenCmd)
+	PubSubCmd.AddCommand(scheduleCmd)
 
 	// hidden/aliased commands
 	PubSubCmd.AddCommand(listCmd)
 	PubSubCmd.AddCommand(whoCmd)
+	PubSubCmd.AddCommand(statsCmd)
 	PubSubCmd.AddCommand(messageCmd)
 	PubSubCmd.AddCommand(sendCmd)
 }
@@ -4,8 +4,6 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
-
-	"github.com/SteveWXT/pubsub/clients"
 )
 
 var (
@@ -24,30 +22,30 @@ var (
 // init
 func init() {
 	listCmd.Flags().StringVar(&host, "host", host, "The IP of a running mist server to connect to")
+	listCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
 }
 
 // list shows a unique list of all subscriptions subscribers are subscribed to
 func list(ccmd *cobra.Command, args []string) error {
 
 	// create new mist client
-	client, err := clients.New(host)
+	client, err := newClient()
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
 	}
 
 	// listall related
-	err = client.ListAll()
+	subscriptions, err := client.ListAll()
 	if err != nil {
 		fmt.Printf("Failed to list - %s\n", err.Error())
 		return err
 	}
 
-	msg := <-client.Messages()
-	if msg.Data == "" {
+	if subscriptions == "" {
 		fmt.Printf("No subscribers connected to PubSub server at '%s'\n", host)
 	} else {
-		fmt.Printf("Subscribers are subscribing on the following tags: %s\n", msg.Data)
+		fmt.Printf("Subscribers are subscribing on the following tags: %s\n", subscriptions)
 	}
 
 	return nil
@@ -4,8 +4,6 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
-
-	"github.com/SteveWXT/pubsub/clients"
 )
 
 var (
@@ -22,12 +20,13 @@ var (
 
 func init() {
 	pingCmd.Flags().StringVar(&host, "host", host, "The IP of a running mist server to connect to")
+	pingCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
 }
 
 // ping
 func ping(ccmd *cobra.Command, args []string) error {
 
-	client, err := clients.New(host)
+	client, err := newClient()
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
@@ -39,8 +38,7 @@ func ping(ccmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	msg := <-client.Messages()
-	fmt.Println(msg.Data)
+	fmt.Println("pong")
 
 	return nil
 }
@@ -2,10 +2,11 @@ package commands
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"github.com/SteveWXT/pubsub/clients"
+	"github.com/SteveWXT/pubsub/core"
 )
 
 var (
@@ -47,7 +48,14 @@ var (
 	}
 )
 
-var data string
+var (
+	data    string
+	headers map[string]string // headers to publish with
+	retain  bool              // whether the server keeps the message as the tags' last value
+	after   time.Duration     // how long the server waits before publishing
+	at      string            // when (RFC3339) the server publishes
+	ttl     time.Duration     // how long after it's published the message expires
+)
 
 // init
 func init() {
@@ -55,6 +63,10 @@ func init() {
 	messageCmd.Flags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
 	sendCmd.Flags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
 
+	publishCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+	messageCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+	sendCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+
 	publishCmd.Flags().StringVar(&data, "data", data, "The string data to publish")
 	messageCmd.Flags().StringVar(&data, "data", data, "The string data to message")
 	sendCmd.Flags().StringVar(&data, "data", data, "The string data to send")
@@ -62,6 +74,26 @@ func init() {
 	publishCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
 	messageCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
 	sendCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
+
+	publishCmd.Flags().StringToStringVar(&headers, "header", headers, "Headers to publish with (key=value)")
+	messageCmd.Flags().StringToStringVar(&headers, "header", headers, "Headers to publish with (key=value)")
+	sendCmd.Flags().StringToStringVar(&headers, "header", headers, "Headers to publish with (key=value)")
+
+	publishCmd.Flags().BoolVar(&retain, "retain", retain, "Keep the message as the tags' last value, sent to whoever subscribes later; without --data, clears it")
+	messageCmd.Flags().BoolVar(&retain, "retain", retain, "Keep the message as the tags' last value, sent to whoever subscribes later; without --data, clears it")
+	sendCmd.Flags().BoolVar(&retain, "retain", retain, "Keep the message as the tags' last value, sent to whoever subscribes later; without --data, clears it")
+
+	publishCmd.Flags().DurationVar(&ttl, "ttl", ttl, "Have the message expire this long (30s) after it's published; it's dropped rather than delivered late")
+	messageCmd.Flags().DurationVar(&ttl, "ttl", ttl, "Have the message expire this long (30s) after it's published; it's dropped rather than delivered late")
+	sendCmd.Flags().DurationVar(&ttl, "ttl", ttl, "Have the message expire this long (30s) after it's published; it's dropped rather than delivered late")
+
+	publishCmd.Flags().DurationVar(&after, "after", after, "Have the server publish the message after this long (10m), rather than now")
+	messageCmd.Flags().DurationVar(&after, "after", after, "Have the server publish the message after this long (10m), rather than now")
+	sendCmd.Flags().DurationVar(&after, "after", after, "Have the server publish the message after this long (10m), rather than now")
+
+	publishCmd.Flags().StringVar(&at, "at", at, "Have the server publish the message at this time (RFC3339), rather than now")
+	messageCmd.Flags().StringVar(&at, "at", at, "Have the server publish the message at this time (RFC3339), rather than now")
+	sendCmd.Flags().StringVar(&at, "at", at, "Have the server publish the message at this time (RFC3339), rather than now")
 }
 
 // publish
@@ -73,19 +105,29 @@ func publish(ccmd *cobra.Command, args []string) error {
 		return fmt.Errorf("")
 	}
 
-	// missing data
-	if data == "" {
+	// missing data; unless clearing a retained message
+	if data == "" && !retain {
 		fmt.Println("Unable to publish - Missing data")
 		return fmt.Errorf("")
 	}
 
-	client, err := clients.New(host)
+	// a scheduled message is published by the server later
+	if after != 0 || at != "" {
+		return publishLater()
+	}
+
+	client, err := newClient()
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
 	}
 
-	err = client.Publish(tags, data)
+	// the server acks the publish, or says why it failed
+	if data == "" {
+		err = client.ClearRetained(tags)
+	} else {
+		_, err = client.PublishMessage(core.Message{Tags: tags, Data: data, Headers: headers, Retain: retain, TTL: ttlString()})
+	}
 	if err != nil {
 		fmt.Printf("Failed to publish message - %s\n", err.Error())
 		return err
@@ -95,3 +137,57 @@ func publish(ccmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// publishLater has the server publish the message --after a while, or --at a
+// time, printing the id it can be cancelled with
+func publishLater() error {
+
+	if after != 0 && at != "" {
+		fmt.Println("Unable to publish - only one of --after and --at")
+		return fmt.Errorf("")
+	}
+
+	if data == "" {
+		fmt.Println("Unable to publish - scheduled messages can't clear a retained message")
+		return fmt.Errorf("")
+	}
+
+	var when time.Time
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			fmt.Printf("Unable to publish - bad --at '%s'; expecting a time like 2006-01-02T15:04:05Z\n", at)
+			return fmt.Errorf("")
+		}
+		when = t
+	}
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	msg := core.Message{Tags: tags, Data: data, Headers: headers, Retain: retain, TTL: ttlString()}
+	if at != "" {
+		msg, err = client.ScheduleAt(msg, when)
+	} else {
+		msg, err = client.ScheduleAfter(msg, after)
+	}
+	if err != nil {
+		fmt.Printf("Failed to schedule message - %s\n", err.Error())
+		return err
+	}
+
+	fmt.Printf("scheduled %s for %s\n", msg.ID, time.Unix(0, msg.Timestamp).Format(time.RFC3339))
+
+	return nil
+}
+
+// ttlString is the --ttl as the server expects it; empty when there isn't one
+func ttlString() string {
+	if ttl == 0 {
+		return ""
+	}
+	return ttl.String()
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/SteveWXT/pubsub/core"
+)
+
+var (
+	timeout = core.RequestTimeout // how long to wait for a reply
+
+	requestCmd = &cobra.Command{
+		Use:           "request",
+		Short:         "Publish a request and wait for a reply",
+		Long:          `The request is published with a 'reply-to' header; whoever receives it replies by publishing to the tag it names`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		RunE: request,
+	}
+)
+
+func init() {
+	requestCmd.Flags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
+	requestCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+	requestCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish the request to")
+	requestCmd.Flags().StringVar(&data, "data", data, "The string data of the request")
+	requestCmd.Flags().DurationVar(&timeout, "timeout", timeout, "How long to wait for a reply")
+	requestCmd.Flags().BoolVar(&verbose, "verbose", verbose, "Show the reply's id, timestamp, publisher, headers and tags along with its data")
+}
+
+// request
+func request(ccmd *cobra.Command, args []string) error {
+
+	// missing tags
+	if tags == nil {
+		fmt.Println("Unable to request - Missing tags")
+		return fmt.Errorf("")
+	}
+
+	if timeout <= 0 {
+		fmt.Println("Unable to request - --timeout must be more than 0")
+		return fmt.Errorf("")
+	}
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	reply, err := client.Request(tags, data, timeout)
+	if err != nil {
+		fmt.Printf("Failed to request - %s\n", err.Error())
+		return err
+	}
+
+	switch {
+	case viper.GetString("log-level") == "DEBUG":
+		fmt.Printf("Message: %#v\n", reply)
+	case verbose:
+		printVerbose(reply)
+	default:
+		fmt.Println(reply.Data)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	scheduleCmd = &cobra.Command{
+		Use:           "schedule",
+		Short:         "Manage messages scheduled with publish --after or --at",
+		Long:          ``,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	scheduleListCmd = &cobra.Command{
+		Use:           "list",
+		Short:         "List the messages waiting to be published",
+		Long:          `Only messages the token could have published itself are listed`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		RunE: scheduleList,
+	}
+
+	scheduleCancelCmd = &cobra.Command{
+		Use:           "cancel [id]",
+		Short:         "Cancel a scheduled message",
+		Long:          ``,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		Args: cobra.ExactArgs(1),
+		RunE: scheduleCancel,
+	}
+)
+
+// init
+func init() {
+	scheduleCmd.PersistentFlags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
+	scheduleCmd.PersistentFlags().StringVar(&token, "token", token, "The token to authenticate with")
+
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleCancelCmd)
+}
+
+// scheduleList
+func scheduleList(ccmd *cobra.Command, args []string) error {
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	scheduled, err := client.ListScheduled()
+	if err != nil {
+		fmt.Printf("Failed to list scheduled messages - %s\n", err.Error())
+		return err
+	}
+
+	for _, msg := range scheduled {
+		fmt.Printf("%s\t%s\ttags: %s\tdata: %s\n", msg.ID, time.Unix(0, msg.Timestamp).Format(time.RFC3339), strings.Join(msg.Tags, ","), msg.Data)
+	}
+
+	return nil
+}
+
+// scheduleCancel
+func scheduleCancel(ccmd *cobra.Command, args []string) error {
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	if err := client.CancelScheduled(args[0]); err != nil {
+		fmt.Printf("Failed to cancel scheduled message - %s\n", err.Error())
+		return err
+	}
+
+	fmt.Println("success")
+	return nil
+}
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsCmd = &cobra.Command{
+		Use:           "stats",
+		Short:         "Show message delivery stats",
+		Long:          ``,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		RunE: stats,
+	}
+)
+
+// init
+func init() {
+	statsCmd.Flags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
+	statsCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+}
+
+// stats gets message delivery stats (queued and dropped messages) for a server
+func stats(ccmd *cobra.Command, args []string) error {
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	delivery, err := client.Stats()
+	if err != nil {
+		fmt.Printf("Failed to get stats - %s\n", err.Error())
+		return err
+	}
+
+	b, err := json.Marshal(delivery)
+	if err != nil {
+		fmt.Printf("Failed to encode stats - %s\n", err.Error())
+		return err
+	}
+
+	fmt.Println(string(b))
+
+	return nil
+}
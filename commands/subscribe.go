@@ -2,14 +2,24 @@ package commands
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
-	"github.com/SteveWXT/pubsub/clients"
+	"github.com/SteveWXT/pubsub/core"
 )
 
 var (
+	expr    string // expression to subscribe to
+	filter  string // filter on the data of messages subscribed to
+	verbose bool   // whether to show messages' ids, timestamps, publishers and headers
+	offset  uint64 // offset in the server's message log to replay from
+	since   string // time (or how long ago) to replay the server's message log from
+	group   string // consumer group to subscribe as a member of
+
 	subscribeCmd = &cobra.Command{
 		Use:           "subscribe",
 		Short:         "Subscribe tags",
@@ -23,42 +33,134 @@ var (
 
 func init() {
 	subscribeCmd.Flags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
-	subscribeCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to subscribe to")
+	subscribeCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
+	subscribeCmd.Flags().StringVar(&expr, "expr", expr, "An expression of tags to subscribe to instead, like '(orders AND eu) OR refunds'")
+	subscribeCmd.Flags().StringVar(&filter, "filter", filter, "Only receive messages whose json data matches the filter, like 'severity >= 3 AND service == \"billing\"'")
+	subscribeCmd.Flags().Uint64Var(&offset, "offset", offset, "Replay the server's message log from this offset before receiving new messages")
+	subscribeCmd.Flags().StringVar(&since, "since", since, "Replay the server's message log from this time (RFC3339), or this long ago (10m), before receiving new messages")
+	subscribeCmd.Flags().StringVar(&group, "group", group, "Subscribe as a member of this consumer group; each message goes to one member, and is acked once it's printed")
+	subscribeCmd.Flags().BoolVar(&verbose, "verbose", verbose, "Show each message's id, timestamp, publisher, headers and tags along with its data")
+	subscribeCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to subscribe to; a '*' in a tag matches any run of characters (log.*), a leading '!' excludes messages with the tag (deploy,!staging)")
 }
 
 // subscribe
 func subscribe(ccmd *cobra.Command, args []string) error {
 
 	// missing tags
-	if tags == nil {
+	if tags == nil && expr == "" {
 		fmt.Println("Unable to subscribe - Missing tags")
 		return fmt.Errorf("")
 	}
 
-	client, err := clients.New(host)
+	if group != "" && (offset != 0 || since != "") {
+		fmt.Println("Unable to subscribe - consumer groups can't replay the message log")
+		return fmt.Errorf("")
+	}
+
+	from, err := parseSince(since)
+	if err != nil {
+		fmt.Printf("Unable to subscribe - %s\n", err.Error())
+		return fmt.Errorf("")
+	}
+
+	client, err := newClient()
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
 	}
 
-	if err := client.Subscribe(tags); err != nil {
+	switch {
+	case group != "" && expr != "":
+		err = client.SubscribeGroupExpr(group, expr, filter)
+	case group != "":
+		err = client.SubscribeGroup(group, tags, filter)
+	case expr != "":
+		err = client.SubscribeExprReplay(expr, filter, offset, from)
+	default:
+		err = client.SubscribeReplay(tags, filter, offset, from)
+	}
+	if err != nil {
 		fmt.Printf("Unable to subscribe - %s\n", err.Error())
 		return fmt.Errorf("")
 	}
 
 	// listen for messages on tags
-	fmt.Printf("Listening on tags '%s'\n", tags)
+	if expr != "" {
+		fmt.Printf("Listening on expression '%s'\n", expr)
+	} else {
+		fmt.Printf("Listening on tags '%s'\n", tags)
+	}
 	for msg := range client.Messages() {
 
-		// skip handler messages
-		if msg.Data != "success" {
-			if viper.GetString("log-level") == "DEBUG" {
-				fmt.Printf("Message: %#v\n", msg)
-			} else {
-				fmt.Println(msg.Data)
+		if msg.Error != "" {
+			fmt.Printf("Error: %s\n", msg.Error)
+			continue
+		}
+
+		// acks are replies to requests, so only published messages get here
+		switch {
+		case viper.GetString("log-level") == "DEBUG":
+			fmt.Printf("Message: %#v\n", msg)
+		case verbose:
+			printVerbose(msg)
+		default:
+			fmt.Println(msg.Data)
+		}
+
+		// group messages are redelivered until they're acked
+		if msg.Group != "" {
+			if err := client.Ack(msg); err != nil {
+				fmt.Printf("Failed to ack - %s\n", err.Error())
 			}
 		}
 	}
 
 	return nil
 }
+
+// parseSince parses a time, or how long ago it was; an empty string is the zero time
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+
+	ago, err := time.ParseDuration(since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad --since '%s'; expecting a time like 2006-01-02T15:04:05Z or a duration like 10m", since)
+	}
+
+	return time.Now().Add(-ago), nil
+}
+
+// printVerbose prints a message with everything the server stamped on it
+func printVerbose(msg core.Message) {
+	fmt.Printf("id: %s\n", msg.ID)
+	if msg.Offset != 0 {
+		fmt.Printf("offset: %d\n", msg.Offset)
+	}
+	if msg.Timestamp != 0 {
+		fmt.Printf("time: %s\n", time.Unix(0, msg.Timestamp).Format(time.RFC3339Nano))
+	}
+	if msg.Expires != 0 {
+		fmt.Printf("expires: %s\n", time.Unix(0, msg.Expires).Format(time.RFC3339Nano))
+	}
+	if msg.Publisher != "" {
+		fmt.Printf("publisher: %s\n", msg.Publisher)
+	}
+
+	keys := []string{}
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("header: %s=%s\n", k, msg.Headers[k])
+	}
+
+	fmt.Printf("tags: %s\n", strings.Join(msg.Tags, ","))
+	fmt.Printf("data: %s\n\n", msg.Data)
+}
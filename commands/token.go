@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/SteveWXT/pubsub/auth"
+)
+
+var (
+	tokenCmd = &cobra.Command{
+		Use:           "token",
+		Short:         "Manage the tokens clients authenticate with",
+		Long:          `Token commands require the --token flag to be the server's master token`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	tokenAddCmd = &cobra.Command{
+		Use:   "add [token]",
+		Short: "Add a token, or the ACL of a client certificate identity",
+		Long: `A token without --publish or --subscribe rules is unrestricted. With
+--identity, the rules are set for clients presenting a certificate with that
+identity instead, and at least one is required`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		Args: tokenArgs,
+		RunE: tokenAdd,
+	}
+
+	tokenRemoveCmd = &cobra.Command{
+		Use:           "remove [token]",
+		Short:         "Remove a token, or the ACL of a client certificate identity",
+		Long:          `With --identity, clients presenting a certificate with that identity are left unrestricted`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		Args: tokenArgs,
+		RunE: tokenRemove,
+	}
+
+	tokenListCmd = &cobra.Command{
+		Use:           "list",
+		Short:         "List all tokens",
+		Long:          ``,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+
+		RunE: tokenList,
+	}
+)
+
+var (
+	publishRules   []string // comma delimited tag sets a token may publish to
+	subscribeRules []string // comma delimited tag sets a token may subscribe to
+	identity       string   // the client certificate identity managed instead of a token
+)
+
+// init
+func init() {
+	tokenCmd.PersistentFlags().StringVar(&host, "host", host, "The IP of a running PubSub server to connect to")
+	tokenCmd.PersistentFlags().StringVar(&token, "token", token, "The master token to authenticate with")
+
+	tokenAddCmd.Flags().StringArrayVar(&publishRules, "publish", publishRules, "A comma delimited tag set the token may publish to (repeatable)")
+	tokenAddCmd.Flags().StringArrayVar(&subscribeRules, "subscribe", subscribeRules, "A comma delimited tag set the token may subscribe to (repeatable)")
+
+	tokenAddCmd.Flags().StringVar(&identity, "identity", identity, "The client certificate identity to set the rules of, rather than a token")
+	tokenRemoveCmd.Flags().StringVar(&identity, "identity", identity, "The client certificate identity to remove the rules of, rather than a token")
+
+	tokenCmd.AddCommand(tokenAddCmd)
+	tokenCmd.AddCommand(tokenRemoveCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+}
+
+// tokenArgs expects a token, or the --identity flag, but not both
+func tokenArgs(ccmd *cobra.Command, args []string) error {
+	if identity != "" {
+		return cobra.NoArgs(ccmd, args)
+	}
+	return cobra.ExactArgs(1)(ccmd, args)
+}
+
+// tokenAdd
+func tokenAdd(ccmd *cobra.Command, args []string) error {
+
+	t := auth.Token{Identity: identity}
+	if identity == "" {
+		t.Token = args[0]
+	}
+
+	// only restrict the token if it was given rules
+	if len(publishRules) != 0 || len(subscribeRules) != 0 {
+		t.ACL = &auth.ACL{Publish: splitRules(publishRules), Subscribe: splitRules(subscribeRules)}
+	}
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	if err := client.AddToken(t); err != nil {
+		fmt.Printf("Failed to add token - %s\n", err.Error())
+		return err
+	}
+
+	fmt.Println("success")
+	return nil
+}
+
+// tokenRemove
+func tokenRemove(ccmd *cobra.Command, args []string) error {
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	if identity != "" {
+		err = client.RemoveIdentity(identity)
+	} else {
+		err = client.RemoveToken(args[0])
+	}
+	if err != nil {
+		fmt.Printf("Failed to remove token - %s\n", err.Error())
+		return err
+	}
+
+	fmt.Println("success")
+	return nil
+}
+
+// tokenList
+func tokenList(ccmd *cobra.Command, args []string) error {
+
+	client, err := newClient()
+	if err != nil {
+		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
+		return err
+	}
+
+	tokens, err := client.ListTokens()
+	if err != nil {
+		fmt.Printf("Failed to list tokens - %s\n", err.Error())
+		return err
+	}
+
+	for _, t := range tokens {
+		name := t.Token
+		if t.Identity != "" {
+			name = "identity: " + t.Identity
+		}
+
+		if t.ACL == nil {
+			fmt.Printf("%s\tunrestricted\n", name)
+			continue
+		}
+		fmt.Printf("%s\tpublish: %s\tsubscribe: %s\n", name, joinRules(t.ACL.Publish), joinRules(t.ACL.Subscribe))
+	}
+
+	return nil
+}
+
+// splitRules splits comma delimited tag sets into rules
+func splitRules(rules []string) (split [][]string) {
+	for _, rule := range rules {
+		split = append(split, strings.Split(rule, ","))
+	}
+	return
+}
+
+// joinRules joins rules into space delimited, comma delimited tag sets
+func joinRules(rules [][]string) string {
+	if len(rules) == 0 {
+		return "none"
+	}
+
+	joined := []string{}
+	for _, rule := range rules {
+		joined = append(joined, strings.Join(rule, ","))
+	}
+	return strings.Join(joined, " ")
+}
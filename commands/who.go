@@ -4,8 +4,6 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
-
-	"github.com/SteveWXT/pubsub/clients"
 )
 
 var (
@@ -24,27 +22,27 @@ var (
 // init
 func init() {
 	whoCmd.Flags().StringVar(&host, "host", host, "The IP of a running mist server to connect to")
+	whoCmd.Flags().StringVar(&token, "token", token, "The token to authenticate with")
 }
 
 // who gets connection stats for a mist server
 func who(ccmd *cobra.Command, args []string) error {
 
 	// create new mist client
-	client, err := clients.New(host)
+	client, err := newClient()
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
 	}
 
 	// who related
-	err = client.Who()
+	who, err := client.Who()
 	if err != nil {
 		fmt.Printf("Failed to who - %s\n", err.Error())
 		return err
 	}
 
-	msg := <-client.Messages()
-	fmt.Println(msg.Data)
+	fmt.Println(who)
 
 	return nil
 }
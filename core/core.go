@@ -2,9 +2,14 @@
 package core
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jcelliott/lumber"
@@ -14,43 +19,179 @@ var (
 	mutex       = &sync.RWMutex{}
 	subscribers = make(map[uint32]*Proxy)
 	uid         uint32
+
+	// index maps tags to the subscribers with a subscription that needs them, so a
+	// publish only has to check the subscribers of its tags; subscribers with a
+	// subscription that can't be indexed by a tag (patterns, exclusions only,
+	// expressions) have to check everything
+	index     = make(map[string]map[uint32]*Proxy)
+	unindexed = make(map[uint32]*Proxy)
+
+	// QueueSize is the most messages a subscriber can have waiting to be sent to
+	// it; once full, OverflowPolicy decides what happens to the next
+	QueueSize = 1000
+
+	// OverflowPolicy is what happens when a message is published to a subscriber
+	// whose queue is full; DropOldest, DropNewest or Disconnect
+	OverflowPolicy = DropOldest
+
+	// counts of messages dropped, and subscribers disconnected, by overflowing queues
+	drops       uint64
+	disconnects uint64
+
+	// count of messages dropped because they expired before they were delivered
+	expirations uint64
+
+	// retained holds the last retained message published to each exact tag set,
+	// by its sorted tags; it's sent to new subscriptions that match it
+	retained  = make(map[string]Message)
+	retainTex sync.Mutex
+
+	// message ids are a prefix unique to this process and a sequence
+	idPrefix = newIDPrefix()
+	idSeq    uint64
+)
+
+const (
+	// DropOldest drops the oldest queued message to make room for the new one
+	DropOldest = "drop-oldest"
+	// DropNewest drops the new message
+	DropNewest = "drop-newest"
+	// Disconnect disconnects the subscriber, which is too slow to keep up
+	Disconnect = "disconnect"
 )
 
 type (
 	// A Message contains the tags used when subscribing, and the data that is being
 	// published through mist
 	Message struct {
-		Command string   `json:"command"`
-		Tags    []string `json:"tags,omitempty"`
-		Data    string   `json:"data,omitempty"`
-		Error   string   `json:"error,omitempty"`
+		Command   string            `json:"command"`
+		RequestID string            `json:"request_id,omitempty"` // chosen by a client sending a command, echoed in the reply to it
+		ID        string            `json:"id,omitempty"`         // unique, assigned by the server when published (or scheduled)
+		Offset    uint64            `json:"offset,omitempty"`     // its place in the message log, if there is one; when subscribing, where to replay the log from
+		Timestamp int64             `json:"timestamp,omitempty"`  // when the message was published, in unix nanoseconds; when subscribing, replay the log from then; when scheduling, publish it then
+		Delay     string            `json:"delay,omitempty"`      // when scheduling, how long to wait before publishing it, like "10s"
+		TTL       string            `json:"ttl,omitempty"`        // when publishing, how long it's delivered for, like "30s"; it's given an Expires from it
+		Expires   int64             `json:"expires,omitempty"`    // when it expires, in unix nanoseconds; it's dropped rather than delivered after
+		Publisher string            `json:"publisher,omitempty"`  // the client certificate identity of the publisher, if it had one
+		Headers   map[string]string `json:"headers,omitempty"`
+		Tags      []string          `json:"tags,omitempty"`
+		Data      string            `json:"data,omitempty"`
+		Filter    string            `json:"filter,omitempty"` // a filter on the data of messages received by a subscription
+		Retain    bool              `json:"retain,omitempty"` // when publishing, keep it as the tags' last value (no data clears it); when received, it's the kept value
+		Group     string            `json:"group,omitempty"`  // the consumer group subscribing to, acking for, or a message was delivered by
+		Error     string            `json:"error,omitempty"`
 	}
 
 	// HandleFunc ...
 	HandleFunc func(*Proxy, Message) error
+
+	// Stats are counts describing the state of message delivery
+	Stats struct {
+		Subscribers    int    `json:"subscribers"`
+		Queued         int    `json:"queued"`       // messages waiting in subscribers' queues
+		Dropped        uint64 `json:"dropped"`      // messages dropped by full queues
+		Disconnected   uint64 `json:"disconnected"` // subscribers disconnected by full queues
+		Expired        uint64 `json:"expired"`      // messages dropped because they expired before they were delivered
+		Retained       int    `json:"retained"`     // tag sets with a retained message
+		Unacked        int    `json:"unacked"`      // consumer group messages waiting to be acked
+		Redelivered    uint64 `json:"redelivered"`  // consumer group messages redelivered
+		Scheduled      int    `json:"scheduled"`    // messages waiting to be published later
+		QueueSize      int    `json:"queue_size"`
+		OverflowPolicy string `json:"overflow_policy"`
+	}
 )
 
-// Subscribers is listall related
-func Subscribers() string {
+// Subscribers returns what every subscriber is subscribed to, sorted and without
+// duplicates; the tags of its subscriptions (filtered, or in a group, or not),
+// and its expressions, whole. Only the subscriptions [allow] allows are listed,
+// like with Subscriptions
+func Subscribers(allow func(tags []string) bool) []string {
 	subs := make(map[string]bool) // no duplicates
-
-	// get tags all clients subscribed to
-	for i := range subscribers {
-		s := subscribers[i].subscriptions.ToSlice()
-		for j := range s {
-			for k := range s[j] {
-				subs[s[j][k]] = true
-			}
+	eachSubscription(allow, func(sub filteredSubscription, group string) {
+		if sub.expr != nil {
+			subs[sub.expr.String()] = true
+			return
 		}
-	}
+		for _, tag := range sub.tags {
+			subs[tag] = true
+		}
+	})
 
 	// slice it
 	subSlice := []string{}
-	for k, _ := range subs {
+	for k := range subs {
 		subSlice = append(subSlice, k)
 	}
+	sort.Strings(subSlice)
+
+	return subSlice
+}
+
+// Subscriptions returns the unique subscriptions of all subscribers, listed the
+// way List lists them. Only the subscriptions [allow] allows are listed; an
+// expression can't be checked against it, so expressions are only listed when
+// [allow] is nil, allowing everything
+func Subscriptions(allow func(tags []string) bool) [][]string {
+	subs := make(map[string][]string) // no duplicates
+	eachSubscription(allow, func(sub filteredSubscription, group string) {
+		set := sub.list()
+		if group != "" {
+			set = append(append([]string{}, set...), "GROUP "+group)
+		}
+		subs[strings.Join(set, ",")] = set
+	})
+
+	// slice it
+	subSlice := [][]string{}
+	for _, v := range subs {
+		subSlice = append(subSlice, v)
+	}
+
+	return subSlice
+}
+
+// eachSubscription calls [fn] with every subscription of every subscriber that
+// [allow] allows, and the group it's in (if it's in one). Reply tags are private
+// to their request, so they're never listed
+func eachSubscription(allow func(tags []string) bool, fn func(sub filteredSubscription, group string)) {
+	visit := func(sub filteredSubscription, group string) {
+		switch {
+		case sub.expr != nil:
+			if allow != nil {
+				return
+			}
+		case HasReplyTag(sub.tags), allow != nil && !allow(sub.tags):
+			return
+		}
+		fn(sub, group)
+	}
 
-	return strings.Join(subSlice, " ")
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// each proxy is locked while it's read, so it can't be subscribing meanwhile
+	for _, p := range subscribers {
+		p.RLock()
+		for _, set := range p.subscriptions.ToSlice() {
+			visit(filteredSubscription{tags: set}, "")
+		}
+		for _, sub := range p.filtered {
+			visit(sub, "")
+		}
+		p.RUnlock()
+	}
+
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	for _, g := range groups {
+		for _, m := range g.members {
+			for _, sub := range m.subs {
+				visit(sub, g.name)
+			}
+		}
+	}
 }
 
 // Who is who related
@@ -58,12 +199,97 @@ func Who() (int, int) {
 	// subs := make(map[string]bool) // no duplicates
 	subs := []string{}
 
+	mutex.RLock()
+	defer mutex.RUnlock()
+
 	// get tags all clients subscribed to
 	for i := range subscribers {
 		subs = append(subs, fmt.Sprint(subscribers[i].id))
 	}
 
-	return len(subs), int(uid)
+	return len(subs), int(atomic.LoadUint32(&uid))
+}
+
+// GetStats returns the current delivery stats
+func GetStats() Stats {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	stats := Stats{
+		Subscribers:    len(subscribers),
+		Dropped:        atomic.LoadUint64(&drops),
+		Disconnected:   atomic.LoadUint64(&disconnects),
+		QueueSize:      QueueSize,
+		OverflowPolicy: OverflowPolicy,
+	}
+
+	for _, p := range subscribers {
+		p.queueTex.Lock()
+		stats.Queued += len(p.queue)
+		p.queueTex.Unlock()
+	}
+
+	retainTex.Lock()
+	expireRetained()
+	stats.Retained = len(retained)
+	retainTex.Unlock()
+
+	stats.Unacked = unacked()
+	stats.Redelivered = atomic.LoadUint64(&redeliveries)
+	stats.Expired = atomic.LoadUint64(&expirations)
+
+	scheduleTex.Lock()
+	stats.Scheduled = len(scheduled)
+	scheduleTex.Unlock()
+
+	return stats
+}
+
+// ValidOverflowPolicy returns an error if [policy] isn't an overflow policy
+func ValidOverflowPolicy(policy string) error {
+	switch policy {
+	case DropOldest, DropNewest, Disconnect:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown overflow policy '%s' - expecting %s, %s or %s", policy, DropOldest, DropNewest, Disconnect)
+}
+
+// ValidTTL returns an error if [ttl] isn't a positive duration, like 30s; an
+// empty ttl is no ttl
+func ValidTTL(ttl string) error {
+	if ttl == "" {
+		return nil
+	}
+
+	if d, err := time.ParseDuration(ttl); err != nil || d <= 0 {
+		return fmt.Errorf("Bad ttl '%s' - expecting a duration like 30s", ttl)
+	}
+
+	return nil
+}
+
+// Identities returns the unique client certificate identities of all subscribers
+func Identities() []string {
+	ids := make(map[string]bool) // no duplicates
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for i := range subscribers {
+		if subscribers[i].Identity != "" {
+			ids[subscribers[i].Identity] = true
+		}
+	}
+
+	// slice it
+	idSlice := []string{}
+	for k := range ids {
+		idSlice = append(idSlice, k)
+	}
+	sort.Strings(idSlice)
+
+	return idSlice
 }
 
 // todo: delete these 2. limiting what is a subscriber makes this not needed
@@ -73,85 +299,313 @@ func Who() (int, int) {
 // who reuse the publish connection for subscribing (publishes to self)
 func Publish(tags []string, data string) error {
 	lumber.Trace("Publishing...")
-	return publish(0, tags, data)
+	_, err := publish(0, Message{Tags: tags, Data: data})
+	return err
 }
 
-// PublishAfter publishes to ALL subscribers. Usefull in client applications
-// who reuse the publish connection for subscribing
+// PublishMessage publishes a message (its tags, data and headers) to ALL
+// subscribers, returning it as it was published; with its ID and Timestamp
+func PublishMessage(msg Message) (Message, error) {
+	lumber.Trace("Publishing message...")
+	return publish(0, msg)
+}
+
+// PublishAfter publishes to ALL subscribers after [delay]. Usefull in client
+// applications who reuse the publish connection for subscribing
 func PublishAfter(tags []string, data string, delay time.Duration) error {
-	go func() {
-		<-time.After(delay)
-		if err := Publish(tags, data); err != nil {
-			// log this error and continue?
-			lumber.Error("Failed to PublishAfter - %s", err.Error())
-		}
-	}()
+	_, err := Schedule(Message{Tags: tags, Data: data}, time.Now().Add(delay))
+	return err
+}
 
-	return nil
+// publish publishes [msg] with a new ID; see deliver
+func publish(pid uint32, msg Message) (Message, error) {
+	msg.ID = newID()
+	return deliver(pid, msg)
 }
 
-// publish publishes to all subscribers except the one who issued the publish
-func publish(pid uint32, tags []string, data string) error {
+// deliver publishes to all subscribers except the one who issued the publish;
+// messages are queued to every subscriber before it returns, and each subscriber
+// receives what it's queued in order, so subscribers receive the messages of a
+// publisher in the order they were published (less any dropped by a full queue).
+// The message keeps its ID, which publish (or schedule) has already given it
+func deliver(pid uint32, msg Message) (Message, error) {
+
+	if len(msg.Tags) == 0 {
+		return msg, fmt.Errorf("Failed to publish. Missing tags")
+	}
+
+	// matching sorts the tags; sorting them once up front keeps every subscriber
+	// from sorting the same slice
+	msg.Tags = append([]string{}, msg.Tags...)
+	sort.Strings(msg.Tags)
+
+	// the server decides these, whatever the publisher sent
+	msg.Command = "publish"
+	msg.Timestamp = time.Now().UnixNano()
+	msg.RequestID, msg.Filter, msg.Error, msg.Group, msg.Delay = "", "", "", "", ""
+	msg.Offset = 0
+
+	msg, err := expiry(msg, time.Unix(0, msg.Timestamp))
+	if err != nil {
+		return msg, err
+	}
+
+	// a scheduled message can come due after it's expired, if the server was down
+	if expired(msg) {
+		dropExpired(msg)
+		return msg, nil
+	}
+
+	// a reply only goes to the proxy waiting on it, and isn't logged or retained;
+	// once its request is answered (or given up on) it goes nowhere
+	if HasReplyTag(msg.Tags) {
+		if len(msg.Tags) == 1 {
+			if p := waiter(msg.Tags[0]); p != nil && p.id != pid {
+				p.enqueue(msg)
+			}
+		}
+		return msg, nil
+	}
 
-	if len(tags) == 0 {
-		return fmt.Errorf("Failed to publish. Missing tags")
+	// the message is written to the log after it's queued, outside the lock, so a
+	// slow disk doesn't hold up every publish and subscribe; the publisher isn't
+	// told it's published until it's logged though
+	log := DefaultLog
+	msg, err = fanOut(pid, msg, log)
+	if err != nil || log == nil || msg.Offset == 0 {
+		return msg, err
 	}
 
+	return msg, log.flush(msg.Offset)
+}
+
+// fanOut queues [msg] to every subscriber it's for, giving it the next offset in
+// [log] (if there is one) first; see deliver
+func fanOut(pid uint32, msg Message, log *Log) (Message, error) {
+
 	// if there are no subscribers, the message goes nowhere
-	//
-	// this could be more optimized, but it might not be an issue unless thousands
-	// of clients are using mist.
-	go func() {
-		mutex.RLock()
-		for _, subscriber := range subscribers {
-			select {
-			case <-subscriber.done:
-				lumber.Trace("Subscriber done")
-				// do nothing?
-
-			default:
-
-				// dont send this message to the publisher who just sent it
-				if subscriber.id == pid {
-					lumber.Trace("Subscriber is publisher, skipping publish")
-					continue
-				}
-
-				// create message
-				msg := Message{Command: "publish", Tags: tags, Data: data}
-
-				// we don't want this operation blocking the range of other subscribers
-				// waiting to get messages
-				go func(p *Proxy, msg Message) {
-					p.check <- msg
-					lumber.Trace("Published message")
-				}(subscriber, msg)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// a retained message without data only clears the tags' retained message
+	retain := msg.Retain
+	msg.Retain = false
+	if retain && msg.Data == "" {
+		retainTex.Lock()
+		delete(retained, retainKey(msg.Tags))
+		retainTex.Unlock()
+		return msg, nil
+	}
+
+	// the message is given its offset under the lock, so a subscriber that starts
+	// replaying the log either finds it in the log, or has it queued (or both)
+	if log != nil {
+		logged, err := log.reserve(msg)
+		if err != nil {
+			return msg, err
+		}
+		msg = logged
+	}
+
+	// kept under the lock too, so a new subscription either gets it as the
+	// retained message or has it queued, never both
+	if retain {
+		kept := msg
+		kept.Retain = true
+		retainTex.Lock()
+		retained[retainKey(msg.Tags)] = kept
+		retainTex.Unlock()
+	}
+
+	for _, subscriber := range candidates(msg.Tags) {
+		select {
+		case <-subscriber.done:
+			lumber.Trace("Subscriber done")
+			// do nothing?
+
+		default:
+
+			// dont send this message to the publisher who just sent it
+			if subscriber.id == pid {
+				lumber.Trace("Subscriber is publisher, skipping publish")
+				continue
 			}
+
+			// queueing doesn't block, so a slow subscriber can't hold up the range
+			// of other subscribers waiting to get messages
+			subscriber.enqueue(msg)
+			lumber.Trace("Published message")
 		}
-		mutex.RUnlock()
-	}()
+	}
 
-	return nil
+	// consumer groups get one copy each, for one of their members
+	dispatchGroups(msg, pid)
+
+	return msg, nil
+}
+
+// newID returns a new message id
+func newID() string {
+	return fmt.Sprintf("%s-%d", idPrefix, atomic.AddUint64(&idSeq, 1))
+}
+
+// newIDPrefix returns a random prefix for the message ids of this process
+func newIDPrefix() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		// the time will do; it only has to differ from other processes'
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// candidates returns the subscribers that might have a subscription matching
+// [tags]; the caller needs to hold the mutex
+func candidates(tags []string) map[uint32]*Proxy {
+	found := make(map[uint32]*Proxy, len(unindexed))
+	for id, p := range unindexed {
+		found[id] = p
+	}
+
+	for _, tag := range tags {
+		for id, p := range index[tag] {
+			found[id] = p
+		}
+	}
+
+	return found
 }
 
-// subscribe adds a proxy to the list of mist subscribers; we need this so that
-// we can lock this process incase multiple proxies are subscribing at the same
-// time
-func subscribe(p *Proxy) {
+// subscribe adds a proxy to the list of mist subscribers, and indexes its current
+// subscriptions; we need this so that we can lock this process incase multiple
+// proxies are subscribing at the same time
+func subscribe(p *Proxy, sub filteredSubscription) {
 	lumber.Trace("Adding proxy to subscribers...")
 
+	keys, all := p.indexKeys()
+
 	mutex.Lock()
 	subscribers[p.id] = p
+	reindex(p, keys, all)
+
+	// the new subscription gets the retained messages it matches ahead of
+	// anything published after it
+	retainTex.Lock()
+	expireRetained()
+	for _, msg := range retained {
+		if sub.match(msg) {
+			p.enqueue(msg)
+		}
+	}
+	retainTex.Unlock()
 	mutex.Unlock()
 }
 
+// expireRetained removes the retained messages that have expired; retainTex
+// must be held
+func expireRetained() {
+	for key, msg := range retained {
+		if expired(msg) {
+			delete(retained, key)
+			dropExpired(msg)
+		}
+	}
+}
+
+// expiry sets [msg]'s Expires to its TTL after [from]; a publisher may send an
+// Expires of its own instead
+func expiry(msg Message, from time.Time) (Message, error) {
+	if msg.TTL == "" {
+		return msg, nil
+	}
+
+	if err := ValidTTL(msg.TTL); err != nil {
+		return msg, err
+	}
+
+	ttl, _ := time.ParseDuration(msg.TTL)
+	msg.Expires = from.Add(ttl).UnixNano()
+	msg.TTL = ""
+	return msg, nil
+}
+
+// expired returns whether [msg] has expired
+func expired(msg Message) bool {
+	return msg.Expires != 0 && time.Now().UnixNano() >= msg.Expires
+}
+
+// DropExpired returns [msgs] without those that have expired, counting them as
+// dropped; for messages kept outside the core, waiting to be delivered
+func DropExpired(msgs []Message) []Message {
+	kept := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if expired(msg) {
+			dropExpired(msg)
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// dropExpired counts [msg] as dropped because it expired; it's called where the
+// message is let go of, so each is only counted once wherever it's kept
+func dropExpired(msg Message) {
+	lumber.Trace("Message '%s' expired, dropping", msg.ID)
+	atomic.AddUint64(&expirations, 1)
+}
+
+// retainKey is the key of a sorted tag set's retained message
+func retainKey(tags []string) string {
+	return strings.Join(tags, "\x00")
+}
+
 // unsubscribe removes a proxy from the list of mist subscribers; we need this
 // so that we can lock this process incase multiple proxies are unsubscribing at
 // the same time
-func unsubscribe(pid uint32) {
+func unsubscribe(p *Proxy) {
 	lumber.Trace("Removing proxy from subscribers...")
 
 	mutex.Lock()
-	delete(subscribers, pid)
+	delete(subscribers, p.id)
+	reindex(p, nil, false)
+	mutex.Unlock()
+
+	leaveGroups(p)
+}
+
+// resubscribe re-indexes a proxy after its subscriptions changed
+func resubscribe(p *Proxy) {
+	keys, all := p.indexKeys()
+
+	mutex.Lock()
+	if _, ok := subscribers[p.id]; ok {
+		reindex(p, keys, all)
+	}
 	mutex.Unlock()
 }
+
+// reindex moves a proxy from the tags it's indexed by to [keys], and in or out of
+// the unindexed subscribers; the caller needs to hold the mutex
+func reindex(p *Proxy, keys []string, all bool) {
+	for _, key := range p.indexed {
+		delete(index[key], p.id)
+		if len(index[key]) == 0 {
+			delete(index, key)
+		}
+	}
+
+	for _, key := range keys {
+		if index[key] == nil {
+			index[key] = make(map[uint32]*Proxy)
+		}
+		index[key][p.id] = p
+	}
+	p.indexed = keys
+
+	if all {
+		unindexed[p.id] = p
+	} else {
+		delete(unindexed, p.id)
+	}
+}
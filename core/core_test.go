@@ -1,7 +1,9 @@
 package core
 
 import (
+	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -55,6 +57,180 @@ func TestPublish(t *testing.T) {
 	verifyNoMessage(p2, t)
 }
 
+// BenchmarkCandidates10k benchmarks finding the subscribers of a message's tags
+// among 10k subscribers with a tag each
+func BenchmarkCandidates10k(b *testing.B) {
+	benchmarkCandidates(b, func(i int) []string { return []string{fmt.Sprintf("tag-%d", i)} })
+}
+
+// BenchmarkCandidates10kUnindexed benchmarks the same with subscriptions that
+// can't be indexed, so every subscriber is a candidate (as they all were without
+// the index)
+func BenchmarkCandidates10kUnindexed(b *testing.B) {
+	benchmarkCandidates(b, func(i int) []string { return []string{fmt.Sprintf("tag-%d*", i)} })
+}
+
+// benchmarkCandidates subscribes 10k proxies to the tags [tags] returns for
+// each, then finds the candidates for a message to one of them
+func benchmarkCandidates(b *testing.B, tags func(i int) []string) {
+	for i := 0; i < 10000; i++ {
+		p := NewProxy()
+		defer p.Close()
+		p.Subscribe(tags(i))
+	}
+
+	msgTags := []string{"tag-5000"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mutex.RLock()
+		candidates(msgTags)
+		mutex.RUnlock()
+	}
+}
+
+// TestIndex tests that publishes only reach subscribers indexed by their tags, or
+// subscribers whose subscriptions can't be indexed
+func TestIndex(t *testing.T) {
+	exact := NewProxy()
+	defer exact.Close()
+	exact.Subscribe([]string{"index-a", "index-b"})
+
+	excluding := NewProxy()
+	defer excluding.Close()
+	excluding.Subscribe([]string{"index-a", "!index-c"})
+
+	pattern := NewProxy()
+	pattern.Subscribe([]string{"index-*"})
+
+	mutex.RLock()
+	found := candidates([]string{"index-b"})
+	mutex.RUnlock()
+	if found[exact.id] != nil || found[excluding.id] != nil || found[pattern.id] == nil {
+		t.Fatalf("Wrong candidates for 'index-b' - %v", found)
+	}
+
+	mutex.RLock()
+	found = candidates([]string{"index-a"})
+	mutex.RUnlock()
+	if found[exact.id] == nil || found[excluding.id] == nil || found[pattern.id] == nil {
+		t.Fatalf("Wrong candidates for 'index-a' - %v", found)
+	}
+
+	// unsubscribing (or closing) removes subscribers from the index
+	exact.Unsubscribe([]string{"index-a", "index-b"})
+	pattern.Close()
+	mutex.RLock()
+	found = candidates([]string{"index-a"})
+	mutex.RUnlock()
+	if found[exact.id] != nil || found[pattern.id] != nil {
+		t.Fatalf("Unsubscribed proxies still candidates - %v", found)
+	}
+	if len(index["index-b"]) != 0 {
+		t.Fatalf("Empty index entry not removed")
+	}
+}
+
+// TestPublishOrder tests that a subscriber receives thousands of messages from a
+// publisher in the order they were published
+func TestPublishOrder(t *testing.T) {
+	defer func(size int) { QueueSize = size }(QueueSize)
+	QueueSize = 10000
+
+	publisher := NewProxy()
+	defer publisher.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+	receiver.Subscribe([]string{"order"})
+
+	for i := 0; i < 5000; i++ {
+		publisher.Publish([]string{"order"}, strconv.Itoa(i))
+	}
+
+	for i := 0; i < 5000; i++ {
+		select {
+		case msg := <-receiver.Pipe:
+			if msg.Data != strconv.Itoa(i) {
+				t.Fatalf("Out of order: Expected '%d' received '%s'", i, msg.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting message %d, received none!", i)
+		}
+	}
+}
+
+// TestPublishOrderConcurrent tests that subscribers receive the messages of each
+// of several concurrent publishers in the order each published them
+func TestPublishOrderConcurrent(t *testing.T) {
+	defer func(size int) { QueueSize = size }(QueueSize)
+	QueueSize = 10000
+
+	receivers := []*Proxy{NewProxy(), NewProxy()}
+	for _, r := range receivers {
+		defer r.Close()
+		r.Subscribe([]string{"order"})
+	}
+
+	publishers, count := 4, 2000
+	for p := 0; p < publishers; p++ {
+		go func(p int) {
+			publisher := NewProxy()
+			defer publisher.Close()
+			for i := 0; i < count; i++ {
+				publisher.Publish([]string{"order"}, fmt.Sprintf("%d:%d", p, i))
+			}
+		}(p)
+	}
+
+	for _, r := range receivers {
+		next := make([]int, publishers)
+		for n := 0; n < publishers*count; n++ {
+			select {
+			case msg := <-r.Pipe:
+				var p, i int
+				fmt.Sscanf(msg.Data, "%d:%d", &p, &i)
+				if i != next[p] {
+					t.Fatalf("Out of order: Expected '%d:%d' received '%s'", p, next[p], msg.Data)
+				}
+				next[p]++
+			case <-time.After(time.Second):
+				t.Fatalf("Expecting message %d, received none!", n)
+			}
+		}
+	}
+}
+
+// TestPublishMessage tests that published messages are stamped with a unique id,
+// a timestamp and their publisher, and keep their headers
+func TestPublishMessage(t *testing.T) {
+	publisher := NewProxy()
+	defer publisher.Close()
+	publisher.Identity = "billing-service"
+
+	receiver := NewProxy()
+	defer receiver.Close()
+	receiver.Subscribe([]string{"stamped"})
+
+	before := time.Now().UnixNano()
+	published, err := publisher.PublishMessage(Message{Tags: []string{"stamped"}, Data: testMsg, ID: "forged", Headers: map[string]string{"trace": "abc"}})
+	if err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	publisher.PublishMessage(Message{Tags: []string{"stamped"}, Data: testMsg})
+
+	first, second := <-receiver.Pipe, <-receiver.Pipe
+	if first.ID == "" || first.ID == "forged" || first.ID == second.ID || first.ID != published.ID {
+		t.Fatalf("Bad message ids - '%s' '%s'", first.ID, second.ID)
+	}
+	if first.Timestamp < before || second.Timestamp < first.Timestamp {
+		t.Fatalf("Bad timestamps - %d %d", first.Timestamp, second.Timestamp)
+	}
+	if first.Publisher != "billing-service" || first.Headers["trace"] != "abc" || first.Command != "publish" {
+		t.Fatalf("Bad message - %#v", first)
+	}
+}
+
 // verifyMessage waits for a message to come to a proxy then tests to see if it's
 // the expected message. After 1 second it assumes no message is coming and fails.
 func verifyMessage(expected string, p *Proxy, t *testing.T) {
@@ -96,3 +272,176 @@ func flattenSliceToString(list [][]string) (flat string) {
 	}
 	return
 }
+
+// TestRetain tests that new subscriptions get the retained messages they match,
+// and that a retained message can be cleared
+func TestRetain(t *testing.T) {
+	defer func() { retained = make(map[string]Message) }()
+
+	PublishMessage(Message{Tags: []string{"status", "db"}, Data: `{"up":false}`, Retain: true})
+	PublishMessage(Message{Tags: []string{"status", "db"}, Data: `{"up":true}`, Retain: true})
+	PublishMessage(Message{Tags: []string{"status", "web"}, Data: `{"up":true}`, Retain: true})
+	PublishMessage(Message{Tags: []string{"status", "cache"}, Data: "not retained"})
+
+	if stats := GetStats(); stats.Retained != 2 {
+		t.Fatalf("Unexpected retained count - %d", stats.Retained)
+	}
+
+	// only the latest value is kept, and only subscriptions it matches get it
+	p := NewProxy()
+	defer p.Close()
+	p.SubscribeFiltered([]string{"db"}, mustParseFilter(`up == true`, t))
+	select {
+	case msg := <-p.Pipe:
+		if msg.Data != `{"up":true}` || !msg.Retain || strings.Join(msg.Tags, ",") != "db,status" {
+			t.Fatalf("Unexpected retained message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting retained message, received none!")
+	}
+
+	// messages published to subscribers aren't marked retained
+	PublishMessage(Message{Tags: []string{"status", "db"}, Data: `{"up":true,"live":true}`, Retain: true})
+	if msg := <-p.Pipe; msg.Retain || msg.Data != `{"up":true,"live":true}` {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+
+	// cleared messages aren't sent
+	PublishMessage(Message{Tags: []string{"db", "status"}, Retain: true})
+	p2 := NewProxy()
+	defer p2.Close()
+	p2.Subscribe([]string{"status"})
+	select {
+	case msg := <-p2.Pipe:
+		if msg.Data != `{"up":true}` || msg.Tags[0] != "status" || msg.Tags[1] != "web" {
+			t.Fatalf("Unexpected retained message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting retained message, received none!")
+	}
+	select {
+	case msg := <-p2.Pipe:
+		t.Fatalf("Unexpected retained message - %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// mustParseFilter parses a filter, failing the test if it's malformed
+func mustParseFilter(s string, t *testing.T) *Filter {
+	filter, err := ParseFilter(s)
+	if err != nil {
+		t.Fatalf("Failed to parse filter - %s", err.Error())
+	}
+	return filter
+}
+
+// TestExpiry tests that messages which expire while they're queued, retained,
+// logged or waiting on a consumer group are dropped rather than delivered
+func TestExpiry(t *testing.T) {
+	defer func() { retained = make(map[string]Message) }()
+	defer resetGroups()
+
+	if _, err := PublishMessage(Message{Tags: []string{"expiry"}, Data: testMsg, TTL: "soon"}); err == nil {
+		t.Fatalf("Expected publishing with a bad ttl to fail")
+	}
+
+	log, err := OpenLog(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+	DefaultLog = log
+	defer func() { DefaultLog = nil; log.Close() }()
+
+	expired := GetStats().Expired
+
+	// the first is taken off the queue, and waits on the pipe; the rest (and the
+	// retained message) expire queued behind it
+	p := NewProxy()
+	defer p.Close()
+	p.Subscribe([]string{"expiry"})
+	for i := 0; i < 3; i++ {
+		PublishMessage(Message{Tags: []string{"expiry"}, Data: fmt.Sprint(i), TTL: "20ms"})
+	}
+	PublishMessage(Message{Tags: []string{"expiry", "kept"}, Data: "kept", TTL: "20ms", Retain: true})
+	time.Sleep(50 * time.Millisecond)
+
+	Publish([]string{"expiry"}, "fresh")
+	verifyMessage("0", p, t)
+	verifyMessage("fresh", p, t)
+
+	// nor are they retained, or replayed
+	p2 := NewProxy()
+	defer p2.Close()
+	p2.Subscribe([]string{"expiry"})
+	if err := p2.ReplayTags([]string{"expiry"}, nil, 1, 0); err != nil {
+		t.Fatalf("Failed to replay - %s", err.Error())
+	}
+	verifyMessage("fresh", p2, t)
+	verifyNoMessage(p2, t)
+
+	// a group stops waiting on them
+	g := NewProxy()
+	g.SubscribeGroup("expiry", []string{"expiry-jobs"}, nil)
+	PublishMessage(Message{Tags: []string{"expiry-jobs"}, Data: testMsg, TTL: "20ms"})
+	<-g.Pipe
+	g.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// 3 queued, 1 retained and 1 waiting on the group; the 4 logged are skipped by
+	// the replay, but they're still in the log, so they aren't counted as dropped
+	if stats := GetStats(); stats.Retained != 0 || stats.Unacked != 0 || stats.Expired-expired != 5 {
+		t.Fatalf("Unexpected stats - %#v", stats)
+	}
+}
+
+// TestSubscribers tests that every kind of subscription is listed, and that a
+// request's reply tag isn't
+func TestSubscribers(t *testing.T) {
+	p := NewProxy()
+	defer p.Close()
+	p.Subscribe([]string{"subs-plain"})
+	p.SubscribeFiltered([]string{"subs-filtered"}, mustParseFilter(`up == true`, t))
+	p.SubscribeGroup("subs", []string{"subs-group"}, nil)
+	defer p.UnsubscribeGroup("subs")
+
+	expr, err := ParseExpr("subs-a OR subs-b")
+	if err != nil {
+		t.Fatalf("Failed to parse expression - %s", err.Error())
+	}
+	p.SubscribeExpr(expr, nil, nil)
+
+	if _, err := p.Request(Message{Tags: []string{"subs-rpc"}, Data: "ping"}, time.Second); err != nil {
+		t.Fatalf("Failed to request - %s", err.Error())
+	}
+
+	listed := map[string]bool{}
+	for _, sub := range Subscribers(nil) {
+		listed[sub] = true
+		if HasReplyTag([]string{sub}) {
+			t.Fatalf("Reply tag listed - %s", sub)
+		}
+	}
+	for _, sub := range []string{"subs-plain", "subs-filtered", "subs-group", expr.String()} {
+		if !listed[sub] {
+			t.Fatalf("Missing '%s' - %v", sub, listed)
+		}
+	}
+
+	// only what's allowed is listed; expressions can't be checked, so they aren't
+	allow := func(tags []string) bool { return tags[0] != "subs-plain" }
+	listed = map[string]bool{}
+	for _, sub := range Subscribers(allow) {
+		listed[sub] = true
+	}
+	if listed["subs-plain"] || listed[expr.String()] || !listed["subs-filtered"] || !listed["subs-group"] {
+		t.Fatalf("Unexpected subscribers - %v", listed)
+	}
+
+	sets := map[string]bool{}
+	for _, set := range Subscriptions(allow) {
+		sets[strings.Join(set, ",")] = true
+	}
+	if sets["subs-plain"] || !sets["subs-filtered,WHERE up == true"] || !sets["subs-group,GROUP subs"] {
+		t.Fatalf("Unexpected subscriptions - %v", sets)
+	}
+}
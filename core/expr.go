@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Expr is a boolean expression over tags, like "(orders AND eu) OR refunds";
+	// it matches a message when it's true of the message's tags. Each tag in it is
+	// true when the message has a tag it matches, so tags may be patterns (log.*),
+	// and a tag starting with '!' is the same as NOT tag
+	Expr struct {
+		op       string // "tag", "and", "or" or "not"
+		tag      string
+		operands []*Expr
+	}
+
+	// exprParser is a recursive descent parser over an expression's tokens
+	exprParser struct {
+		tokens []string
+		pos    int
+	}
+)
+
+// ParseExpr parses an expression; AND binds tighter than OR, NOT tighter than
+// AND, and parenthesis group. The keywords aren't case sensitive
+func ParseExpr(s string) (*Expr, error) {
+	parser := &exprParser{tokens: tokenizeExpr(s)}
+	if len(parser.tokens) == 0 {
+		return nil, fmt.Errorf("Failed to parse expression - empty expression")
+	}
+
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("Failed to parse expression - unexpected '%s'", parser.tokens[parser.pos])
+	}
+
+	return expr, nil
+}
+
+// Match returns whether the expression is true of [tags]
+func (expr *Expr) Match(tags []string) bool {
+	switch expr.op {
+	case "and":
+		for _, operand := range expr.operands {
+			if !operand.Match(tags) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, operand := range expr.operands {
+			if operand.Match(tags) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !expr.operands[0].Match(tags)
+	}
+
+	for _, tag := range tags {
+		if matchTag(expr.tag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the expression in its canonical form, which parses back into
+// the same expression
+func (expr *Expr) String() string {
+	switch expr.op {
+	case "and", "or":
+		parts := make([]string, len(expr.operands))
+		for i, operand := range expr.operands {
+			parts[i] = operand.String()
+
+			// an OR inside an AND needs grouping to keep its meaning
+			if expr.op == "and" && operand.op == "or" {
+				parts[i] = "(" + parts[i] + ")"
+			}
+		}
+		return strings.Join(parts, " "+strings.ToUpper(expr.op)+" ")
+	case "not":
+		if operand := expr.operands[0]; operand.op == "and" || operand.op == "or" {
+			return "NOT (" + operand.String() + ")"
+		}
+		return "NOT " + expr.operands[0].String()
+	}
+
+	return expr.tag
+}
+
+// tokenizeExpr splits an expression into parenthesis and words
+func tokenizeExpr(s string) (tokens []string) {
+	word := ""
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')':
+			if word != "" {
+				tokens = append(tokens, word)
+				word = ""
+			}
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if word != "" {
+				tokens = append(tokens, word)
+				word = ""
+			}
+		default:
+			word += string(r)
+		}
+	}
+
+	if word != "" {
+		tokens = append(tokens, word)
+	}
+
+	return
+}
+
+// parseOr parses operands joined by OR
+func (parser *exprParser) parseOr() (*Expr, error) {
+	return parser.parseJoined("or", parser.parseAnd)
+}
+
+// parseAnd parses operands joined by AND
+func (parser *exprParser) parseAnd() (*Expr, error) {
+	return parser.parseJoined("and", parser.parseNot)
+}
+
+// parseJoined parses one or more operands joined by the [op] keyword, flattening
+// them into a single expression
+func (parser *exprParser) parseJoined(op string, parseOperand func() (*Expr, error)) (*Expr, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Expr{operand}
+	for parser.keyword(op) {
+		parser.pos++
+
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		// a AND (b AND c) is a AND b AND c
+		if operand.op == op {
+			operands = append(operands, operand.operands...)
+		} else {
+			operands = append(operands, operand)
+		}
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+
+	return &Expr{op: op, operands: operands}, nil
+}
+
+// parseNot parses a NOT, a parenthesized expression, or a tag
+func (parser *exprParser) parseNot() (*Expr, error) {
+	if parser.pos >= len(parser.tokens) {
+		return nil, fmt.Errorf("Failed to parse expression - unexpected end of expression")
+	}
+
+	token := parser.tokens[parser.pos]
+	switch {
+	case parser.keyword("not"):
+		parser.pos++
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{op: "not", operands: []*Expr{operand}}, nil
+
+	case token == "(":
+		parser.pos++
+		expr, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.pos >= len(parser.tokens) || parser.tokens[parser.pos] != ")" {
+			return nil, fmt.Errorf("Failed to parse expression - missing ')'")
+		}
+		parser.pos++
+		return expr, nil
+
+	case token == ")" || parser.keyword("and") || parser.keyword("or"):
+		return nil, fmt.Errorf("Failed to parse expression - unexpected '%s'", token)
+	}
+
+	parser.pos++
+	if IsExclusion(token) {
+		return &Expr{op: "not", operands: []*Expr{{op: "tag", tag: token[1:]}}}, nil
+	}
+
+	return &Expr{op: "tag", tag: token}, nil
+}
+
+// keyword returns whether the current token is the [keyword]
+func (parser *exprParser) keyword(keyword string) bool {
+	return parser.pos < len(parser.tokens) && strings.EqualFold(parser.tokens[parser.pos], keyword)
+}
@@ -0,0 +1,114 @@
+package core
+
+import "testing"
+
+// TestExprMatch tests that expressions match the tags they're true of
+func TestExprMatch(t *testing.T) {
+	expr, err := ParseExpr("(orders AND eu) OR refunds")
+	if err != nil {
+		t.Fatalf("Failed to parse - %s", err.Error())
+	}
+
+	if !expr.Match([]string{"eu", "orders"}) || !expr.Match([]string{"refunds"}) || !expr.Match([]string{"refunds", "us"}) {
+		t.Fatalf("Expected match!")
+	}
+	if expr.Match([]string{"orders"}) || expr.Match([]string{"eu", "us"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// NOT binds tighter than AND, which binds tighter than OR
+	expr, err = ParseExpr("deploy and not staging or rollback")
+	if err != nil {
+		t.Fatalf("Failed to parse - %s", err.Error())
+	}
+	if !expr.Match([]string{"deploy"}) || !expr.Match([]string{"rollback", "staging"}) {
+		t.Fatalf("Expected match!")
+	}
+	if expr.Match([]string{"deploy", "staging"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// tags can be patterns or exclusions
+	expr, err = ParseExpr("log.* AND !log.debug")
+	if err != nil {
+		t.Fatalf("Failed to parse - %s", err.Error())
+	}
+	if !expr.Match([]string{"log.error"}) {
+		t.Fatalf("Expected match!")
+	}
+	if expr.Match([]string{"log.debug"}) {
+		t.Fatalf("Unexpected match!")
+	}
+}
+
+// TestExprString tests that expressions print in a canonical form that parses
+// back into the same expression
+func TestExprString(t *testing.T) {
+	tests := map[string]string{
+		"a":                          "a",
+		"(orders AND eu) OR refunds": "orders AND eu OR refunds",
+		"a and (b or c)":             "a AND (b OR c)",
+		"a AND (b AND c)":            "a AND b AND c",
+		"not (a or b)":               "NOT (a OR b)",
+		"!a":                         "NOT a",
+	}
+
+	for in, out := range tests {
+		expr, err := ParseExpr(in)
+		if err != nil {
+			t.Fatalf("Failed to parse '%s' - %s", in, err.Error())
+		}
+		if expr.String() != out {
+			t.Fatalf("Wrong form - Expecting '%s' got '%s'", out, expr.String())
+		}
+
+		again, err := ParseExpr(expr.String())
+		if err != nil || again.String() != out {
+			t.Fatalf("Canonical form '%s' didn't parse back", out)
+		}
+	}
+}
+
+// TestExprErrors tests that malformed expressions don't parse
+func TestExprErrors(t *testing.T) {
+	for _, in := range []string{"", "a AND", "OR a", "(a OR b", "a OR b)", "a b", "NOT"} {
+		if _, err := ParseExpr(in); err == nil {
+			t.Fatalf("Parsed malformed expression '%s'", in)
+		}
+	}
+}
+
+// TestSubscribeExpr tests that a proxy receives the messages its expression
+// subscriptions (and their filters) match
+func TestSubscribeExpr(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	expr, _ := ParseExpr("(orders AND eu) OR refunds")
+	receiver.SubscribeExpr(expr, nil, func(tags []string) bool {
+		for _, tag := range tags {
+			if tag == "secret" {
+				return false
+			}
+		}
+		return true
+	})
+
+	sender.Publish([]string{"orders", "eu"}, testMsg)
+	verifyMessage(testMsg, receiver, t)
+	sender.Publish([]string{"orders"}, testMsg)
+	verifyNoMessage(receiver, t)
+	sender.Publish([]string{"refunds", "secret"}, testMsg)
+	verifyNoMessage(receiver, t)
+
+	if list := receiver.List(); len(list) != 1 || list[0][0] != "orders AND eu OR refunds" {
+		t.Fatalf("Wrong subscriptions - %v", list)
+	}
+
+	receiver.UnsubscribeExpr(expr, nil)
+	sender.Publish([]string{"refunds"}, testMsg)
+	verifyNoMessage(receiver, t)
+}
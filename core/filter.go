@@ -0,0 +1,402 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Filter is a predicate on the fields of a message's json data, narrowing what
+	// a subscription receives beyond its tags. A filter is made of comparisons,
+	// combined with AND, OR, NOT and parenthesis like an expression:
+	//
+	//	severity >= 3 AND (service == "billing" OR NOT user.internal == true)
+	//
+	// A comparison is a field, an operator (==, !=, <, <=, > or >=) and a value; a
+	// number, a quoted string, true, false or null. Fields are dotted paths into
+	// the data (user.id; items.0.sku for arrays). Comparisons against fields that
+	// are missing, or of a different type than the value, are false (!= included),
+	// as are all comparisons when the data isn't json
+	Filter struct {
+		op       string // "cmp", "and", "or" or "not"
+		field    string
+		cmp      string
+		value    interface{} // float64, string, bool or nil
+		operands []*Filter
+	}
+
+	// filterParser is a recursive descent parser over a filter's tokens
+	filterParser struct {
+		tokens []string
+		pos    int
+	}
+)
+
+// ParseFilter parses a filter, returning an error saying where it went wrong if
+// it's malformed
+func ParseFilter(s string) (*Filter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	if len(parser.tokens) == 0 {
+		return nil, fmt.Errorf("Failed to parse filter - empty filter")
+	}
+
+	filter, err := parser.parseJoined("or")
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("Failed to parse filter - unexpected '%s'", parser.tokens[parser.pos])
+	}
+
+	return filter, nil
+}
+
+// Match returns whether the filter is true of a message's [data]
+func (filter *Filter) Match(data string) bool {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return false
+	}
+
+	return filter.match(doc)
+}
+
+// match evaluates the filter against decoded json
+func (filter *Filter) match(doc interface{}) bool {
+	switch filter.op {
+	case "and":
+		for _, operand := range filter.operands {
+			if !operand.match(doc) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, operand := range filter.operands {
+			if operand.match(doc) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !filter.operands[0].match(doc)
+	}
+
+	field, ok := lookupField(doc, filter.field)
+	if !ok {
+		return false
+	}
+
+	return compare(field, filter.cmp, filter.value)
+}
+
+// String returns the filter in its canonical form, which parses back into the
+// same filter
+func (filter *Filter) String() string {
+	switch filter.op {
+	case "and", "or":
+		parts := make([]string, len(filter.operands))
+		for i, operand := range filter.operands {
+			parts[i] = operand.String()
+
+			// an OR inside an AND needs grouping to keep its meaning
+			if filter.op == "and" && operand.op == "or" {
+				parts[i] = "(" + parts[i] + ")"
+			}
+		}
+		return strings.Join(parts, " "+strings.ToUpper(filter.op)+" ")
+	case "not":
+		if operand := filter.operands[0]; operand.op == "and" || operand.op == "or" {
+			return "NOT (" + operand.String() + ")"
+		}
+		return "NOT " + filter.operands[0].String()
+	}
+
+	// values are kept as they were written; not html escaped like json.Marshal would
+	var value bytes.Buffer
+	encoder := json.NewEncoder(&value)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(filter.value)
+
+	return fmt.Sprintf("%s %s %s", filter.field, filter.cmp, strings.TrimSuffix(value.String(), "\n"))
+}
+
+// lookupField follows a dotted [path] into decoded json
+func lookupField(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			field, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			doc = field
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// compare compares a field to a value of the same type
+func compare(field interface{}, cmp string, value interface{}) bool {
+	switch v := value.(type) {
+	case float64:
+		f, ok := field.(float64)
+		if !ok {
+			return false
+		}
+		switch cmp {
+		case "==":
+			return f == v
+		case "!=":
+			return f != v
+		case "<":
+			return f < v
+		case "<=":
+			return f <= v
+		case ">":
+			return f > v
+		case ">=":
+			return f >= v
+		}
+	case string:
+		s, ok := field.(string)
+		if !ok {
+			return false
+		}
+		switch cmp {
+		case "==":
+			return s == v
+		case "!=":
+			return s != v
+		case "<":
+			return s < v
+		case "<=":
+			return s <= v
+		case ">":
+			return s > v
+		case ">=":
+			return s >= v
+		}
+	case bool:
+		b, ok := field.(bool)
+		if !ok {
+			return false
+		}
+		switch cmp {
+		case "==":
+			return b == v
+		case "!=":
+			return b != v
+		}
+	case nil:
+		switch cmp {
+		case "==":
+			return field == nil
+		case "!=":
+			return field != nil
+		}
+	}
+
+	return false
+}
+
+// tokenizeFilter splits a filter into parenthesis, operators, quoted strings and
+// words
+func tokenizeFilter(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			// two character operators first
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+				continue
+			}
+			if c == '=' || c == '!' {
+				return nil, fmt.Errorf("Failed to parse filter - unknown operator '%c' at %d", c, i)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("Failed to parse filter - unterminated string at %d", i)
+			}
+			tokens = append(tokens, s[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r()=!<>\"'", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+
+	return
+}
+
+// parseJoined parses one or more operands joined by the [op] keyword, flattening
+// them into a single filter; OR's operands are joined by AND
+func (parser *filterParser) parseJoined(op string) (*Filter, error) {
+	parseOperand := parser.parseNot
+	if op == "or" {
+		parseOperand = func() (*Filter, error) { return parser.parseJoined("and") }
+	}
+
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Filter{operand}
+	for parser.keyword(op) {
+		parser.pos++
+
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		if operand.op == op {
+			operands = append(operands, operand.operands...)
+		} else {
+			operands = append(operands, operand)
+		}
+	}
+
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+
+	return &Filter{op: op, operands: operands}, nil
+}
+
+// parseNot parses a NOT, a parenthesized filter, or a comparison
+func (parser *filterParser) parseNot() (*Filter, error) {
+	token, ok := parser.next()
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse filter - unexpected end of filter")
+	}
+
+	switch {
+	case strings.EqualFold(token, "not"):
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{op: "not", operands: []*Filter{operand}}, nil
+
+	case token == "(":
+		filter, err := parser.parseJoined("or")
+		if err != nil {
+			return nil, err
+		}
+		if token, ok := parser.next(); !ok || token != ")" {
+			return nil, fmt.Errorf("Failed to parse filter - missing ')'")
+		}
+		return filter, nil
+	}
+
+	return parser.parseComparison(token)
+}
+
+// parseComparison parses the operator and value comparing [field]
+func (parser *filterParser) parseComparison(field string) (*Filter, error) {
+	if !isField(field) {
+		return nil, fmt.Errorf("Failed to parse filter - expected a field, got '%s'", field)
+	}
+
+	cmp, ok := parser.next()
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse filter - missing operator after '%s'", field)
+	}
+	switch cmp {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("Failed to parse filter - expected an operator after '%s', got '%s'", field, cmp)
+	}
+
+	token, ok := parser.next()
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse filter - missing value after '%s %s'", field, cmp)
+	}
+
+	var value interface{}
+	switch {
+	case token[0] == '"' || token[0] == '\'':
+		value = token[1 : len(token)-1]
+	case token == "true", token == "false":
+		value = token == "true"
+	case token == "null":
+		value = nil
+	default:
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse filter - bad value '%s'; strings need quotes", token)
+		}
+		value = f
+	}
+
+	// only numbers and strings are ordered
+	if _, ordered := value.(float64); !ordered && cmp != "==" && cmp != "!=" {
+		if _, ordered = value.(string); !ordered {
+			return nil, fmt.Errorf("Failed to parse filter - '%s' can't compare to %s", cmp, token)
+		}
+	}
+
+	return &Filter{op: "cmp", field: field, cmp: cmp, value: value}, nil
+}
+
+// next returns the current token and moves past it
+func (parser *filterParser) next() (string, bool) {
+	if parser.pos >= len(parser.tokens) {
+		return "", false
+	}
+
+	parser.pos++
+	return parser.tokens[parser.pos-1], true
+}
+
+// keyword returns whether the current token is the [keyword]
+func (parser *filterParser) keyword(keyword string) bool {
+	return parser.pos < len(parser.tokens) && strings.EqualFold(parser.tokens[parser.pos], keyword)
+}
+
+// isField returns whether a token can be a field path
+func isField(token string) bool {
+	if token == "" || token[0] == '"' || token[0] == '\'' || token == ")" || token == "(" {
+		return false
+	}
+
+	switch strings.ToLower(token) {
+	case "and", "or", "not", "true", "false", "null":
+		return false
+	}
+
+	return !strings.ContainsAny(token, "=<>")
+}
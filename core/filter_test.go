@@ -0,0 +1,86 @@
+package core
+
+import "testing"
+
+// TestFilterMatch tests that filters match the data they're true of
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		data   string
+		match  bool
+	}{
+		{`severity >= 3`, `{"severity":3}`, true},
+		{`severity >= 3`, `{"severity":2}`, false},
+		{`severity >= 3`, `{"severity":"high"}`, false},
+		{`severity >= 3`, `{}`, false},
+		{`severity >= 3`, `not json`, false},
+		{`service == "billing"`, `{"service":"billing"}`, true},
+		{`service == 'billing'`, `{"service":"orders"}`, false},
+		{`service != "billing"`, `{"service":"orders"}`, true},
+		{`service != "billing"`, `{}`, false},
+		{`user.admin == true`, `{"user":{"admin":true}}`, true},
+		{`items.1.sku == "b"`, `{"items":[{"sku":"a"},{"sku":"b"}]}`, true},
+		{`items.2.sku == "b"`, `{"items":[{"sku":"a"},{"sku":"b"}]}`, false},
+		{`owner == null`, `{"owner":null}`, true},
+		{`severity > 1 AND (service == "billing" OR service == "orders")`, `{"severity":2,"service":"orders"}`, true},
+		{`severity > 1 and not service == "billing"`, `{"severity":2,"service":"billing"}`, false},
+		{`team == "R&D <ops>"`, `{"team":"R&D <ops>"}`, true},
+	}
+
+	for _, test := range tests {
+		filter, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Fatalf("Failed to parse '%s' - %s", test.filter, err.Error())
+		}
+		if filter.Match(test.data) != test.match {
+			t.Fatalf("Filter '%s' on '%s' - Expecting %v", test.filter, test.data, test.match)
+		}
+
+		// the canonical form parses back into the same filter
+		again, err := ParseFilter(filter.String())
+		if err != nil || again.String() != filter.String() {
+			t.Fatalf("Canonical form '%s' didn't parse back", filter.String())
+		}
+	}
+
+	// the canonical form is what was written, not html escaped
+	if filter, _ := ParseFilter(`team == "R&D <ops>"`); filter.String() != `team == "R&D <ops>"` {
+		t.Fatalf("Wrong canonical form - %s", filter.String())
+	}
+}
+
+// TestFilterErrors tests that malformed filters don't parse
+func TestFilterErrors(t *testing.T) {
+	for _, in := range []string{"", "severity", "severity >=", "severity = 3", "severity >= high", `"severity" == 3`,
+		`service == "billing`, "a == 1 AND", "(a == 1", "a == 1)", "flag > true"} {
+		if _, err := ParseFilter(in); err == nil {
+			t.Fatalf("Parsed malformed filter '%s'", in)
+		}
+	}
+}
+
+// TestSubscribeFiltered tests that a proxy only receives messages matching the
+// filter of a filtered subscription
+func TestSubscribeFiltered(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	filter, _ := ParseFilter("severity >= 3")
+	receiver.SubscribeFiltered([]string{"alerts"}, filter)
+
+	sender.Publish([]string{"alerts"}, `{"severity":4}`)
+	verifyMessage(`{"severity":4}`, receiver, t)
+	sender.Publish([]string{"alerts"}, `{"severity":1}`)
+	verifyNoMessage(receiver, t)
+
+	if list := receiver.List(); len(list) != 1 || len(list[0]) != 2 || list[0][1] != "WHERE severity >= 3" {
+		t.Fatalf("Wrong subscriptions - %v", list)
+	}
+
+	receiver.UnsubscribeFiltered([]string{"alerts"}, filter)
+	sender.Publish([]string{"alerts"}, `{"severity":4}`)
+	verifyNoMessage(receiver, t)
+}
@@ -0,0 +1,515 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// AckTimeout is how long a consumer group member has to ack a message before
+	// it's redelivered to another member of the group
+	AckTimeout = 30 * time.Second
+
+	// groups are the consumer groups, by name; guarded by groupTex, which is taken
+	// after the core mutex when both are needed
+	groups   = make(map[string]*group)
+	groupTex sync.Mutex
+
+	// count of group messages redelivered because they weren't acked in time, or
+	// the member they were delivered to left
+	redeliveries uint64
+
+	// groupPath is the file the messages groups are waiting on are saved to, so
+	// they survive a restart; empty when they aren't saved. Guarded by groupTex
+	groupPath string
+
+	// groupSave is signaled when the messages groups are waiting on change, so
+	// they're saved again; saveTex keeps saves from overlapping
+	groupSave  = make(chan struct{}, 1)
+	groupSaver sync.Once
+	saveTex    sync.Mutex
+)
+
+type (
+	// group is a named consumer group. Rather than every member receiving every
+	// message their subscriptions match, each message is delivered to just one of
+	// them; the one with the fewest unacked messages, taking turns when that's a
+	// tie. A message is redelivered until it's acked, and messages waiting on a
+	// member (every member left with them unacked) are kept until one joins, up
+	// to QueueSize of them. With OpenGroups, the messages a group is waiting on
+	// survive a restart
+	group struct {
+		name     string
+		members  []*member            // in the order they joined
+		next     int                  // the member whose turn it is
+		inflight map[string]*delivery // unacked messages, by id
+		backlog  []Message            // unacked messages waiting for a member
+	}
+
+	// member is a proxy's membership of a group
+	member struct {
+		proxy    *Proxy
+		subs     map[string]filteredSubscription // by how they're listed
+		inflight int
+	}
+
+	// delivery is a message delivered to a member, waiting on its ack
+	delivery struct {
+		msg    Message
+		member *member
+		timer  *time.Timer
+	}
+)
+
+// joinGroup adds [sub] to the proxy's subscriptions in the [name]d group, joining
+// (or creating) the group if the proxy isn't a member of it yet
+func joinGroup(p *Proxy, name string, sub filteredSubscription) {
+	lumber.Trace("Proxy joining group '%s'...", name)
+
+	mutex.Lock()
+	subscribers[p.id] = p
+	mutex.Unlock()
+
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	g, ok := groups[name]
+	if !ok {
+		g = &group{name: name, inflight: map[string]*delivery{}}
+		groups[name] = g
+	}
+
+	m := g.member(p.id)
+	if m == nil {
+		m = &member{proxy: p, subs: map[string]filteredSubscription{}}
+		g.members = append(g.members, m)
+	}
+	m.subs[sub.String()] = sub
+
+	// a new member may be able to take the messages left waiting
+	backlog := g.backlog
+	g.backlog = nil
+	for _, msg := range backlog {
+		g.dispatch(msg, 0, 0)
+	}
+}
+
+// leaveGroup removes the proxy from the [name]d group; the messages it hasn't
+// acked are redelivered
+func leaveGroup(p *Proxy, name string) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	if g, ok := groups[name]; ok {
+		g.leave(p)
+	}
+}
+
+// leaveGroups removes the proxy from every group it's a member of
+func leaveGroups(p *Proxy) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	for _, g := range groups {
+		g.leave(p)
+	}
+}
+
+// dispatchGroups delivers [msg] to a member of each group with one whose
+// subscriptions match it; never to the proxy that published it
+func dispatchGroups(msg Message, pid uint32) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	for _, g := range groups {
+		if g.match(msg, pid) {
+			g.dispatch(msg, pid, 0)
+		}
+	}
+}
+
+// ackGroup acks the message with [id] delivered to the proxy by the [name]d
+// group, so it isn't redelivered
+func ackGroup(p *Proxy, name, id string) error {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	g, ok := groups[name]
+	if !ok {
+		return fmt.Errorf("Failed to ack - unknown group '%s'", name)
+	}
+
+	d, ok := g.inflight[id]
+	if !ok || d.member.proxy != p {
+		return fmt.Errorf("Failed to ack - no unacked message '%s'", id)
+	}
+
+	d.timer.Stop()
+	delete(g.inflight, id)
+	d.member.inflight--
+	groupsChanged()
+
+	return nil
+}
+
+// forget stops the [name]d group waiting on the ack of the message with [id],
+// which expired before it could be sent
+func forget(name, id string) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	if g, ok := groups[name]; ok {
+		if d, ok := g.inflight[id]; ok {
+			d.timer.Stop()
+			delete(g.inflight, id)
+			d.member.inflight--
+			groupsChanged()
+		}
+	}
+}
+
+// redeliver redelivers the message of delivery [d] if the [name]d group is still
+// waiting on its ack; a message redelivered since isn't redelivered again early
+// by the timer of a delivery before
+func redeliver(name string, d *delivery) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	g, ok := groups[name]
+	if !ok {
+		return
+	}
+
+	id := d.msg.ID
+	if g.inflight[id] != d {
+		return
+	}
+
+	lumber.Debug("Message '%s' unacked by group '%s', redelivering", id, name)
+	delete(g.inflight, id)
+	d.member.inflight--
+	atomic.AddUint64(&redeliveries, 1)
+
+	// another member gets a turn, if there is one
+	g.dispatch(d.msg, 0, d.member.proxy.id)
+}
+
+// groupSubscriptions returns the proxy's group subscriptions as they're listed;
+// each ends with the group it's in ("GROUP workers")
+func groupSubscriptions(p *Proxy) (data [][]string) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	for _, g := range groups {
+		if m := g.member(p.id); m != nil {
+			for _, sub := range m.subs {
+				data = append(data, append(sub.list(), "GROUP "+g.name))
+			}
+		}
+	}
+
+	sort.Slice(data, func(i, j int) bool { return fmt.Sprint(data[i]) < fmt.Sprint(data[j]) })
+	return
+}
+
+// unacked counts the messages delivered by groups that haven't been acked yet;
+// expired messages waiting for a member are dropped first
+func unacked() (count int) {
+	groupTex.Lock()
+	defer groupTex.Unlock()
+
+	for _, g := range groups {
+		backlog := g.backlog[:0]
+		for _, msg := range g.backlog {
+			if expired(msg) {
+				dropExpired(msg)
+				groupsChanged()
+				continue
+			}
+			backlog = append(backlog, msg)
+		}
+		g.backlog = backlog
+
+		if len(g.members) == 0 && len(g.inflight) == 0 && len(g.backlog) == 0 {
+			delete(groups, g.name)
+			continue
+		}
+
+		count += len(g.inflight) + len(g.backlog)
+	}
+	return
+}
+
+// dispatch delivers [msg] to the member pick chooses, or keeps it in the backlog
+// if there's no member to take it; an expired message is dropped instead.
+// groupTex must be held
+func (g *group) dispatch(msg Message, skip, avoid uint32) {
+	groupsChanged()
+
+	if expired(msg) {
+		dropExpired(msg)
+		return
+	}
+
+	m := g.pick(msg, skip, avoid)
+	if m == nil {
+		g.keep(msg)
+		return
+	}
+
+	msg.Group = g.name
+	d := &delivery{msg: msg, member: m}
+	d.timer = time.AfterFunc(AckTimeout, func() { redeliver(g.name, d) })
+
+	g.inflight[msg.ID] = d
+	m.inflight++
+	m.proxy.enqueue(msg)
+}
+
+// keep adds [msg] to the backlog, to wait for a member; once the backlog has
+// QueueSize messages the OverflowPolicy decides whether the oldest or this one is
+// dropped (there's no member to disconnect, so Disconnect drops this one).
+// groupTex must be held
+func (g *group) keep(msg Message) {
+	if len(g.backlog) >= QueueSize {
+		lumber.Trace("Group '%s' backlog full, dropping message", g.name)
+		atomic.AddUint64(&drops, 1)
+
+		if OverflowPolicy != DropOldest || len(g.backlog) == 0 {
+			return
+		}
+		g.backlog[0] = Message{} // let the message be collected
+		g.backlog = g.backlog[1:]
+	}
+
+	g.backlog = append(g.backlog, msg)
+}
+
+// pick chooses the member to deliver [msg] to; of those whose subscriptions match
+// it, the one with the fewest unacked messages, starting from the member whose
+// turn it is. The [skip] proxy is never picked, and the [avoid] proxy only if no
+// other member can take the message
+func (g *group) pick(msg Message, skip, avoid uint32) *member {
+	var picked, fallback *member
+	pickedAt := 0
+
+	for i := range g.members {
+		at := (g.next + i) % len(g.members)
+		m := g.members[at]
+		if m.proxy.id == skip || !m.match(msg) {
+			continue
+		}
+
+		if m.proxy.id == avoid {
+			fallback = m
+			continue
+		}
+
+		if picked == nil || m.inflight < picked.inflight {
+			picked, pickedAt = m, at
+		}
+	}
+
+	if picked == nil {
+		return fallback
+	}
+
+	g.next = (pickedAt + 1) % len(g.members)
+	return picked
+}
+
+// match returns whether any member but the [skip] proxy has a subscription that
+// matches [msg]
+func (g *group) match(msg Message, skip uint32) bool {
+	for _, m := range g.members {
+		if m.proxy.id != skip && m.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// member returns the member with the proxy [id], if there is one
+func (g *group) member(id uint32) *member {
+	for _, m := range g.members {
+		if m.proxy.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// leave removes the proxy from the group, redelivering what it hasn't acked; an
+// empty group with nothing waiting on a member is removed
+func (g *group) leave(p *Proxy) {
+	for i, m := range g.members {
+		if m.proxy != p {
+			continue
+		}
+
+		g.members = append(g.members[:i:i], g.members[i+1:]...)
+		if g.next > i {
+			g.next--
+		}
+		if len(g.members) != 0 {
+			g.next %= len(g.members)
+		} else {
+			g.next = 0
+		}
+
+		orphaned := []*delivery{}
+		for id, d := range g.inflight {
+			if d.member == m {
+				d.timer.Stop()
+				delete(g.inflight, id)
+				orphaned = append(orphaned, d)
+			}
+		}
+
+		// redelivered in the order they were published
+		sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].msg.Timestamp < orphaned[j].msg.Timestamp })
+		for _, d := range orphaned {
+			atomic.AddUint64(&redeliveries, 1)
+			g.dispatch(d.msg, 0, 0)
+		}
+		break
+	}
+
+	if len(g.members) == 0 && len(g.inflight) == 0 && len(g.backlog) == 0 {
+		delete(groups, g.name)
+	}
+}
+
+// match returns whether any of the member's subscriptions match [msg]
+func (m *member) match(msg Message) bool {
+	for _, sub := range m.subs {
+		if sub.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenGroups saves the messages consumer groups are waiting on (unacked, or
+// waiting for a member) to the file at [path] from now on, and restores those
+// already saved there; they wait for the groups' members to join again. Saves
+// are made in the background as the messages change, so a crash can lose the
+// last moment's changes
+func OpenGroups(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read groups - %s", err.Error())
+	}
+
+	saved := map[string][]Message{}
+	if len(b) != 0 {
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return fmt.Errorf("Failed to parse groups - %s", err.Error())
+		}
+	}
+
+	groupTex.Lock()
+	groupPath = path
+	for name, msgs := range saved {
+		g, ok := groups[name]
+		if !ok {
+			g = &group{name: name, inflight: map[string]*delivery{}}
+			groups[name] = g
+		}
+
+		for _, msg := range msgs {
+			msg.Group = ""
+			g.dispatch(msg, 0, 0)
+		}
+	}
+	groupTex.Unlock()
+
+	groupSaver.Do(func() { go saveGroups() })
+
+	lumber.Debug("Restored %d saved groups", len(saved))
+	return nil
+}
+
+// groupsChanged has the messages groups are waiting on saved again, if they're
+// saved; groupTex must be held
+func groupsChanged() {
+	if groupPath == "" {
+		return
+	}
+
+	select {
+	case groupSave <- struct{}{}:
+	default:
+	}
+}
+
+// saveGroups saves the messages groups are waiting on each time they change;
+// changes made while it's saving are saved together after
+func saveGroups() {
+	for range groupSave {
+		if err := writeGroups(); err != nil {
+			lumber.Error(err.Error())
+		}
+	}
+}
+
+// writeGroups writes the messages groups are waiting on to the groups file, if
+// there is one; they're copied under groupTex, and written after. The file is
+// replaced whole, so a crash mid-write leaves the last one
+func writeGroups() error {
+	saveTex.Lock()
+	defer saveTex.Unlock()
+
+	groupTex.Lock()
+	path := groupPath
+	waiting := groupMessages()
+	groupTex.Unlock()
+
+	if path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(waiting)
+	if err != nil {
+		return fmt.Errorf("Failed to save groups - %s", err.Error())
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("Failed to save groups - %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Failed to save groups - %s", err.Error())
+	}
+
+	return nil
+}
+
+// groupMessages returns the messages each group is waiting on, by group, oldest
+// first; groupTex must be held
+func groupMessages() map[string][]Message {
+	waiting := map[string][]Message{}
+	for name, g := range groups {
+		msgs := make([]Message, 0, len(g.inflight)+len(g.backlog))
+		for _, d := range g.inflight {
+			msgs = append(msgs, d.msg)
+		}
+		msgs = append(msgs, g.backlog...)
+
+		if len(msgs) == 0 {
+			continue
+		}
+
+		sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Timestamp < msgs[j].Timestamp })
+		waiting[name] = msgs
+	}
+	return waiting
+}
@@ -0,0 +1,309 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestGroup tests that each message goes to one member of a group, taking turns,
+// while other subscribers still get every message
+func TestGroup(t *testing.T) {
+	defer resetGroups()
+
+	a, b, other := NewProxy(), NewProxy(), NewProxy()
+	defer a.Close()
+	defer b.Close()
+	defer other.Close()
+
+	a.SubscribeGroup("workers", []string{"jobs"}, nil)
+	b.SubscribeGroup("workers", []string{"jobs"}, nil)
+	other.Subscribe([]string{"jobs"})
+
+	counts := map[*Proxy]int{}
+	for i := 0; i < 4; i++ {
+		Publish([]string{"jobs"}, testMsg)
+
+		select {
+		case msg := <-other.Pipe:
+			if msg.Group != "" {
+				t.Fatalf("Unexpected group on broadcast message - %#v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting message, received none!")
+		}
+
+		for _, p := range []*Proxy{a, b} {
+			select {
+			case msg := <-p.Pipe:
+				if msg.Group != "workers" {
+					t.Fatalf("Unexpected group - %#v", msg)
+				}
+				if err := p.Ack("workers", msg.ID); err != nil {
+					t.Fatalf("Failed to ack - %s", err.Error())
+				}
+				counts[p]++
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	if counts[a] != 2 || counts[b] != 2 {
+		t.Fatalf("Uneven delivery - %d %d", counts[a], counts[b])
+	}
+
+	// acking twice, or another member's message, fails
+	Publish([]string{"jobs"}, testMsg)
+	msg := <-a.Pipe
+	if err := b.Ack("workers", msg.ID); err == nil {
+		t.Fatalf("Acked another member's message")
+	}
+	a.Ack("workers", msg.ID)
+	if err := a.Ack("workers", msg.ID); err == nil {
+		t.Fatalf("Acked a message twice")
+	}
+
+	// the member with fewer unacked messages is picked, even out of turn
+	for i := 0; i < 4; i++ {
+		Publish([]string{"jobs"}, testMsg)
+	}
+	for i := 0; i < 2; i++ {
+		a.Ack("workers", (<-a.Pipe).ID)
+		<-b.Pipe
+	}
+	Publish([]string{"jobs"}, testMsg)
+	Publish([]string{"jobs"}, testMsg)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-a.Pipe:
+		case msg := <-b.Pipe:
+			t.Fatalf("Expected the least loaded member, b got - %#v", msg)
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting message, received none!")
+		}
+	}
+}
+
+// TestGroupRedeliver tests that messages are redelivered when they aren't acked
+// in time, or their member leaves, and wait for a member when there isn't one
+func TestGroupRedeliver(t *testing.T) {
+	defer resetGroups()
+
+	timeout := AckTimeout
+	AckTimeout = 50 * time.Millisecond
+	defer func() { AckTimeout = timeout }()
+	redelivered := GetStats().Redelivered
+
+	a, b := NewProxy(), NewProxy()
+	defer b.Close()
+
+	a.SubscribeGroup("redeliver", []string{"jobs"}, nil)
+	b.SubscribeGroup("redeliver", []string{"jobs"}, nil)
+
+	// a doesn't ack, so b gets it
+	Publish([]string{"jobs"}, testMsg)
+	first := <-a.Pipe
+	select {
+	case msg := <-b.Pipe:
+		if msg.ID != first.ID {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+		b.Ack("redeliver", msg.ID)
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting redelivery, received none!")
+	}
+
+	// from here on nothing is redelivered for taking too long
+	AckTimeout = timeout
+
+	// a leaves with a message unacked, so b gets it
+	Publish([]string{"jobs"}, testMsg)
+	select {
+	case msg := <-a.Pipe:
+		a.Close()
+		if redelivered := <-b.Pipe; redelivered.ID != msg.ID {
+			t.Fatalf("Unexpected message - %#v", redelivered)
+		}
+	case msg := <-b.Pipe:
+		t.Fatalf("Expected a's turn, b got - %#v", msg)
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+
+	// b leaves with it unacked too; with no members left it waits for the next
+	b.UnsubscribeGroup("redeliver")
+	if GetStats().Unacked != 1 {
+		t.Fatalf("Unexpected unacked count - %d", GetStats().Unacked)
+	}
+
+	c := NewProxy()
+	defer c.Close()
+	c.SubscribeGroup("redeliver", []string{"jobs"}, nil)
+	select {
+	case msg := <-c.Pipe:
+		c.Ack("redeliver", msg.ID)
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting waiting message, received none!")
+	}
+
+	if stats := GetStats(); stats.Unacked != 0 || stats.Redelivered-redelivered != 3 {
+		t.Fatalf("Unexpected stats - %#v", stats)
+	}
+}
+
+// TestGroupStaleRedeliver tests that the ack timer of an earlier delivery of a
+// message doesn't redeliver it again early
+func TestGroupStaleRedeliver(t *testing.T) {
+	defer resetGroups()
+
+	a, b := NewProxy(), NewProxy()
+	defer a.Close()
+	defer b.Close()
+
+	a.SubscribeGroup("stale", []string{"jobs"}, nil)
+	b.SubscribeGroup("stale", []string{"jobs"}, nil)
+
+	Publish([]string{"jobs"}, testMsg)
+	first := <-a.Pipe
+
+	groupTex.Lock()
+	stale := groups["stale"].inflight[first.ID]
+	groupTex.Unlock()
+
+	// redelivered to b, then the first delivery's timer fires late
+	redeliver("stale", stale)
+	<-b.Pipe
+	redelivered := GetStats().Redelivered
+	redeliver("stale", stale)
+
+	select {
+	case msg := <-a.Pipe:
+		t.Fatalf("Unexpected redelivery - %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if stats := GetStats(); stats.Unacked != 1 || stats.Redelivered != redelivered {
+		t.Fatalf("Unexpected stats - %#v", stats)
+	}
+}
+
+// TestGroupBacklog tests that a group left without members keeps no more than
+// QueueSize of the messages its members left unacked
+func TestGroupBacklog(t *testing.T) {
+	defer resetGroups()
+	defer func(size int, policy string) { QueueSize, OverflowPolicy = size, policy }(QueueSize, OverflowPolicy)
+
+	for _, policy := range []string{DropOldest, DropNewest, Disconnect} {
+		QueueSize, OverflowPolicy = 10, policy
+
+		// a leaves with 4 unacked, which wait for a member
+		a := NewProxy()
+		a.SubscribeGroup("backlog", []string{"jobs"}, nil)
+		for i := 0; i < 4; i++ {
+			Publish([]string{"jobs"}, fmt.Sprint(i))
+		}
+
+		QueueSize = 2
+		dropped := GetStats().Dropped
+		a.Close()
+
+		if stats := GetStats(); stats.Unacked != 2 || stats.Dropped-dropped != 2 {
+			t.Fatalf("Unexpected stats for %s - %#v", policy, stats)
+		}
+
+		// the oldest were dropped, or the newest
+		want := []string{"2", "3"}
+		if policy != DropOldest {
+			want = []string{"0", "1"}
+		}
+
+		b := NewProxy()
+		b.SubscribeGroup("backlog", []string{"jobs"}, nil)
+		for _, data := range want {
+			select {
+			case msg := <-b.Pipe:
+				if msg.Data != data {
+					t.Fatalf("Unexpected message for %s - %#v", policy, msg)
+				}
+				b.Ack("backlog", msg.ID)
+			case <-time.After(time.Second):
+				t.Fatalf("Expecting waiting message, received none!")
+			}
+		}
+		b.Close()
+	}
+}
+
+// TestGroupPersist tests that the messages a group is waiting on are saved, and
+// restored when the groups are reopened
+func TestGroupPersist(t *testing.T) {
+	defer resetGroups()
+
+	path := filepath.Join(t.TempDir(), "groups.json")
+	if err := OpenGroups(path); err != nil {
+		t.Fatalf("Failed to open groups - %s", err.Error())
+	}
+
+	// one acked, and two left unacked
+	a := NewProxy()
+	a.SubscribeGroup("persist", []string{"jobs"}, nil)
+	for _, data := range []string{"first", "acked", "second"} {
+		Publish([]string{"jobs"}, data)
+	}
+	for i := 0; i < 3; i++ {
+		if msg := <-a.Pipe; msg.Data == "acked" {
+			a.Ack("persist", msg.ID)
+		}
+	}
+	a.Close()
+
+	if err := writeGroups(); err != nil {
+		t.Fatalf("Failed to save groups - %s", err.Error())
+	}
+
+	// a restart
+	resetGroups()
+	if err := OpenGroups(path); err != nil {
+		t.Fatalf("Failed to reopen groups - %s", err.Error())
+	}
+	if unacked := GetStats().Unacked; unacked != 2 {
+		t.Fatalf("Unexpected unacked count - %d", unacked)
+	}
+
+	b := NewProxy()
+	defer b.Close()
+	b.SubscribeGroup("persist", []string{"jobs"}, nil)
+	for _, data := range []string{"first", "second"} {
+		select {
+		case msg := <-b.Pipe:
+			if msg.Data != data || msg.Group != "persist" {
+				t.Fatalf("Unexpected message - %#v", msg)
+			}
+			b.Ack("persist", msg.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting restored message, received none!")
+		}
+	}
+
+	// once they're acked, there's nothing to restore
+	if err := writeGroups(); err != nil {
+		t.Fatalf("Failed to save groups - %s", err.Error())
+	}
+	resetGroups()
+	if err := OpenGroups(path); err != nil {
+		t.Fatalf("Failed to reopen groups - %s", err.Error())
+	}
+	if unacked := GetStats().Unacked; unacked != 0 {
+		t.Fatalf("Unexpected unacked count once acked - %d", unacked)
+	}
+}
+
+// resetGroups forgets every group, and the messages they're waiting on, and
+// stops saving them
+func resetGroups() {
+	groupTex.Lock()
+	groups = make(map[string]*group)
+	groupPath = ""
+	groupTex.Unlock()
+}
@@ -0,0 +1,451 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// DefaultLog, when opened, stores every published message so subscribers can
+	// replay what they missed; nil when messages aren't logged
+	DefaultLog *Log
+
+	// ErrNoLog is returned when replaying without a message log
+	ErrNoLog = fmt.Errorf("Failed to replay - no message log is configured")
+
+	// LogRetentionInterval is how often an open log removes the segments it no
+	// longer retains, so a log nobody's publishing to still shrinks
+	LogRetentionInterval = time.Minute
+)
+
+type (
+	// Log is an append-only, on-disk log of published messages, each stored with an
+	// offset one greater than the last. The log is split into segments, files of
+	// json messages one per line named for the offset of their first message; once
+	// a segment reaches SegmentSize a new one is started, and the oldest segments
+	// are removed when the log outgrows RetentionSize or they're older than
+	// RetentionAge (zero keeps everything). A segment is synced to disk when it's
+	// finished with, or every write is with SyncWrites
+	Log struct {
+		sync.Mutex
+
+		SegmentSize   int64
+		RetentionSize int64
+		RetentionAge  time.Duration
+		SyncWrites    bool
+
+		dir      string
+		segments []*segment // oldest first; the last is appended to
+		next     uint64     // the offset the next message is given
+
+		// messages are given their offsets under the lock, and written in that
+		// order afterwards by whoever takes writeTex next; the segment files are
+		// only touched with writeTex held, so the lock is never held for long
+		pending  []pendingWrite
+		failed   map[uint64]error // offsets that failed to be written, until they're reported
+		writeTex sync.Mutex
+		done     chan struct{}
+	}
+
+	// pendingWrite is a message given an offset, waiting to be written
+	pendingWrite struct {
+		offset uint64
+		line   []byte
+	}
+
+	// segment is one of the log's files
+	segment struct {
+		base     uint64 // the offset of its first message
+		path     string
+		size     int64
+		modified time.Time // when it was last appended to
+		file     *os.File  // open while it's being appended to
+	}
+)
+
+// OpenLog opens (or creates) the log in [dir], continuing from the last message
+// already in it
+func OpenLog(dir string, segmentSize, retentionSize int64, retentionAge time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create message log - %s", err.Error())
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open message log - %s", err.Error())
+	}
+
+	log := &Log{SegmentSize: segmentSize, RetentionSize: retentionSize, RetentionAge: retentionAge, dir: dir, next: 1, failed: map[uint64]error{}, done: make(chan struct{})}
+	for _, path := range paths {
+		base, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".log"), 10, 64)
+		if err != nil {
+			continue // not a segment
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open message log - %s", err.Error())
+		}
+
+		log.segments = append(log.segments, &segment{base: base, path: path, size: info.Size(), modified: info.ModTime()})
+	}
+	sort.Slice(log.segments, func(i, j int) bool { return log.segments[i].base < log.segments[j].base })
+
+	// the next offset follows the last message in the newest segment; a message
+	// cut short by a crash is ignored, and overwritten
+	if len(log.segments) != 0 {
+		last := log.segments[len(log.segments)-1]
+		log.next = last.base
+
+		size, err := last.scan(func(msg Message) bool {
+			log.next = msg.Offset + 1
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read message log - %s", err.Error())
+		}
+
+		if size != last.size {
+			if err := os.Truncate(last.path, size); err != nil {
+				return nil, fmt.Errorf("Failed to repair message log - %s", err.Error())
+			}
+			last.size = size
+		}
+	}
+
+	if err := log.roll(log.next); err != nil {
+		return nil, err
+	}
+
+	go log.retainEvery(LogRetentionInterval)
+
+	return log, nil
+}
+
+// Append stores [msg] with the next offset, returning it with the offset set
+func (log *Log) Append(msg Message) (Message, error) {
+	msg, err := log.reserve(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	return msg, log.flush(msg.Offset)
+}
+
+// reserve gives [msg] the next offset, returning it with the offset set; it's
+// written by the next flush. Nothing is written, so it's quick enough to do
+// under the core lock, which offsets have to be given out under
+func (log *Log) reserve(msg Message) (Message, error) {
+	log.Lock()
+	defer log.Unlock()
+
+	msg.Offset = log.next
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return msg, fmt.Errorf("Failed to log message - %s", err.Error())
+	}
+
+	log.pending = append(log.pending, pendingWrite{offset: msg.Offset, line: append(b, '\n')})
+	log.next++
+
+	return msg, nil
+}
+
+// flush writes every message reserved so far, in order, returning the error
+// writing the one with [offset], if it failed; with SyncWrites they're synced to
+// disk before it returns
+func (log *Log) flush(offset uint64) error {
+	log.writeTex.Lock()
+	defer log.writeTex.Unlock()
+
+	log.Lock()
+	pending := log.pending
+	log.pending = nil
+	log.Unlock()
+
+	failed := map[uint64]error{}
+	for _, w := range pending {
+		if err := log.write(w); err != nil {
+			failed[w.offset] = err
+		}
+	}
+
+	if log.SyncWrites && len(pending) != 0 {
+		if err := log.segments[len(log.segments)-1].file.Sync(); err != nil {
+			for _, w := range pending {
+				failed[w.offset] = fmt.Errorf("Failed to log message - %s", err.Error())
+			}
+		}
+	}
+
+	// another flush may have written (or failed to write) [offset], so what failed
+	// is kept until it's reported to whoever reserved it
+	log.Lock()
+	defer log.Unlock()
+
+	for failedOffset, err := range failed {
+		lumber.Error("Failed to log message %d - %s", failedOffset, err.Error())
+		log.failed[failedOffset] = err
+	}
+	err := log.failed[offset]
+	delete(log.failed, offset)
+
+	return err
+}
+
+// write appends a reserved message to the newest segment, rolling over to a new
+// one if it's full; writeTex has to be held
+func (log *Log) write(w pendingWrite) error {
+	active := log.segments[len(log.segments)-1]
+	if active.size != 0 && active.size+int64(len(w.line)) > log.SegmentSize && log.SegmentSize > 0 {
+		if err := log.roll(w.offset); err != nil {
+			return err
+		}
+		active = log.segments[len(log.segments)-1]
+	}
+
+	if _, err := active.file.Write(w.line); err != nil {
+		return fmt.Errorf("Failed to log message - %s", err.Error())
+	}
+
+	log.Lock()
+	active.size += int64(len(w.line))
+	active.modified = time.Now()
+	log.Unlock()
+
+	log.retain()
+
+	return nil
+}
+
+// Next returns the offset the next message appended will be given
+func (log *Log) Next() uint64 {
+	log.Lock()
+	defer log.Unlock()
+
+	return log.next
+}
+
+// Read calls [fn] with each message in the log from offset [from] up to (but not
+// including) offset [to], skipping those published before [since] (in unix
+// nanoseconds); it stops early if [fn] returns false. Messages removed by
+// retention are skipped, so reading starts from the oldest one left
+func (log *Log) Read(from, to uint64, since int64, fn func(Message) bool) error {
+	// the messages before [to] may have been given their offsets, but not written
+	// yet
+	log.flush(0)
+
+	// copy the segments, as the newest changes while it's appended to
+	log.Lock()
+	segments := make([]segment, len(log.segments))
+	for i, seg := range log.segments {
+		segments[i] = *seg
+	}
+	log.Unlock()
+
+	for i := range segments {
+		seg := &segments[i]
+
+		// skip segments that end before [from], or were last written before [since]
+		if i+1 < len(segments) && segments[i+1].base <= from {
+			continue
+		}
+		if since != 0 && seg.modified.UnixNano() < since {
+			continue
+		}
+		if seg.base >= to {
+			return nil
+		}
+
+		done := false
+		_, err := seg.scan(func(msg Message) bool {
+			switch {
+			case msg.Offset >= to:
+				done = true
+			case msg.Offset < from || msg.Timestamp < since:
+				return true
+			default:
+				done = !fn(msg)
+			}
+			return !done
+		})
+
+		// retention may remove a segment while it's being read
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to read message log - %s", err.Error())
+		}
+		if done {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Close writes what's left to write, and syncs and closes the segment being
+// appended to
+func (log *Log) Close() error {
+	log.flush(0)
+
+	log.writeTex.Lock()
+	defer log.writeTex.Unlock()
+
+	select {
+	case <-log.done:
+		return nil
+	default:
+		close(log.done)
+	}
+
+	if len(log.segments) == 0 || log.segments[len(log.segments)-1].file == nil {
+		return nil
+	}
+
+	return closeSegment(log.segments[len(log.segments)-1].file)
+}
+
+// roll starts appending to a new segment, starting at offset [base]; an empty
+// newest segment (left by a restart, say) is appended to instead. The segment
+// it's done with is synced to disk first. writeTex has to be held (or the log
+// not yet opened)
+func (log *Log) roll(base uint64) error {
+	var seg *segment
+	if n := len(log.segments); n != 0 && log.segments[n-1].size == 0 {
+		seg = log.segments[n-1]
+	} else {
+		if n != 0 && log.segments[n-1].file != nil {
+			if err := closeSegment(log.segments[n-1].file); err != nil {
+				return fmt.Errorf("Failed to finish log segment - %s", err.Error())
+			}
+		}
+
+		seg = &segment{base: base, path: filepath.Join(log.dir, fmt.Sprintf("%020d.log", base))}
+	}
+
+	file := seg.file
+	if file == nil {
+		var err error
+		file, err = os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to start log segment - %s", err.Error())
+		}
+	}
+
+	log.Lock()
+	if n := len(log.segments); n == 0 || log.segments[n-1] != seg {
+		log.segments = append(log.segments, seg)
+	}
+	seg.file = file
+	seg.modified = time.Now()
+	log.Unlock()
+
+	log.retain()
+
+	return nil
+}
+
+// closeSegment syncs a segment's file to disk, and closes it
+func closeSegment(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// retainEvery removes the segments the log no longer retains every [interval],
+// until the log is closed
+func (log *Log) retainEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.writeTex.Lock()
+			log.retain()
+			log.writeTex.Unlock()
+		case <-log.done:
+			return
+		}
+	}
+}
+
+// retain removes the oldest segments while the log is larger than RetentionSize,
+// or they're older than RetentionAge; the segment being appended to is kept.
+// writeTex has to be held (or the log not yet opened)
+func (log *Log) retain() {
+	log.Lock()
+	size := int64(0)
+	for _, seg := range log.segments {
+		size += seg.size
+	}
+
+	removed := []*segment{}
+	for len(log.segments) > 1 {
+		oldest := log.segments[0]
+
+		tooBig := log.RetentionSize > 0 && size > log.RetentionSize
+		tooOld := log.RetentionAge > 0 && time.Since(oldest.modified) > log.RetentionAge
+		if !tooBig && !tooOld {
+			break
+		}
+
+		size -= oldest.size
+		log.segments = log.segments[1:]
+		removed = append(removed, oldest)
+	}
+	log.Unlock()
+
+	// a segment that fails to be removed is left behind, until it's found again
+	// when the log is reopened
+	for _, seg := range removed {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			lumber.Error("Failed to remove log segment - %s", err.Error())
+			continue
+		}
+		lumber.Debug("Removed log segment '%s'", seg.path)
+	}
+}
+
+// scan calls [fn] with each message in the segment until it returns false,
+// returning how far into the segment the last whole message's line ends
+func (seg *segment) scan(fn func(Message) bool) (end int64, err error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		msg := Message{}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return end, nil
+			}
+			return end, err
+		}
+		end = decoder.InputOffset() + 1 // the newline after it
+
+		if !fn(msg) {
+			return end, nil
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLog tests appending to, reading and reopening the message log
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := OpenLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+
+	for i := 1; i <= 5; i++ {
+		msg, err := log.Append(Message{Tags: []string{"a"}, Data: fmt.Sprint(i), Timestamp: int64(i)})
+		if err != nil {
+			t.Fatalf("Failed to append - %s", err.Error())
+		}
+		if msg.Offset != uint64(i) {
+			t.Fatalf("Unexpected offset - %d", msg.Offset)
+		}
+	}
+
+	if data := readLog(log, 2, 5, 0, t); data != "234" {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+	if data := readLog(log, 1, log.Next(), 4, t); data != "45" {
+		t.Fatalf("Unexpected messages since - %s", data)
+	}
+
+	// a message cut short by a crash is ignored, and the log continues after the
+	// last whole one
+	log.Close()
+	file, _ := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d.log", 1)), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"command":"publish","offset":6,"da`)
+	file.Close()
+
+	log, err = OpenLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen log - %s", err.Error())
+	}
+	defer log.Close()
+
+	if log.Next() != 6 {
+		t.Fatalf("Unexpected next offset - %d", log.Next())
+	}
+	log.Append(Message{Tags: []string{"a"}, Data: "6"})
+	if data := readLog(log, 1, log.Next(), 0, t); data != "123456" {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+}
+
+// TestLogRetention tests that the log rolls over to new segments, and removes
+// the oldest to stay under its retention size and age
+func TestLogRetention(t *testing.T) {
+	dir := t.TempDir()
+
+	// every message is its own segment
+	log, err := OpenLog(dir, 1, 200, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+	defer log.Close()
+
+	for i := 1; i <= 9; i++ {
+		log.Append(Message{Tags: []string{"a"}, Data: fmt.Sprint(i)})
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(segments) >= 9 || len(segments) < 2 {
+		t.Fatalf("Unexpected segments - %v", segments)
+	}
+
+	// reading from a removed offset starts at the oldest message left
+	data := readLog(log, 1, log.Next(), 0, t)
+	if len(data) != len(segments) || data[len(data)-1] != '9' {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+
+	log.RetentionAge = time.Nanosecond
+	log.Append(Message{Tags: []string{"a"}, Data: "0"})
+	if data := readLog(log, 1, log.Next(), 0, t); data != "0" {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+}
+
+// TestLogRetentionIdle tests that segments are removed as they age, even when
+// nothing is appended to the log
+func TestLogRetentionIdle(t *testing.T) {
+	interval := LogRetentionInterval
+	LogRetentionInterval = 10 * time.Millisecond
+	defer func() { LogRetentionInterval = interval }()
+
+	dir := t.TempDir()
+	log, err := OpenLog(dir, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+	defer log.Close()
+
+	for i := 1; i <= 3; i++ {
+		log.Append(Message{Tags: []string{"a"}, Data: fmt.Sprint(i)})
+	}
+
+	log.Lock()
+	log.RetentionAge = 50 * time.Millisecond
+	log.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(segments) != 1 {
+		t.Fatalf("Unexpected segments - %v", segments)
+	}
+}
+
+// TestLogReserve tests that a message given an offset can be read before it's
+// written, and that it's written once
+func TestLogReserve(t *testing.T) {
+	log, err := OpenLog(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+	defer log.Close()
+
+	msg, err := log.reserve(Message{Tags: []string{"a"}, Data: "1"})
+	if err != nil || msg.Offset != 1 {
+		t.Fatalf("Failed to reserve - %v %#v", err, msg)
+	}
+	if data := readLog(log, 1, log.Next(), 0, t); data != "1" {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+
+	if err := log.flush(msg.Offset); err != nil {
+		t.Fatalf("Failed to flush - %s", err.Error())
+	}
+	if data := readLog(log, 1, log.Next(), 0, t); data != "1" {
+		t.Fatalf("Unexpected messages - %s", data)
+	}
+}
+
+// TestReplay tests that a subscriber replaying the log receives what it missed,
+// then what's published, without gaps or repeats
+func TestReplay(t *testing.T) {
+	p := NewProxy()
+	defer p.Close()
+
+	if err := p.ReplayTags([]string{"replay"}, nil, 1, 0); err != ErrNoLog {
+		t.Fatalf("Expected replaying without a log to fail")
+	}
+
+	log, err := OpenLog(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open log - %s", err.Error())
+	}
+	DefaultLog = log
+	defer func() { DefaultLog = nil; log.Close() }()
+
+	for i := 0; i < 100; i++ {
+		Publish([]string{"replay"}, fmt.Sprint(i))
+		Publish([]string{"other"}, fmt.Sprint(i))
+	}
+
+	// keep publishing while the subscriber catches up
+	go func() {
+		for i := 100; i < 200; i++ {
+			Publish([]string{"replay"}, fmt.Sprint(i))
+		}
+	}()
+
+	p.Subscribe([]string{"replay"})
+	if err := p.ReplayTags([]string{"replay"}, nil, 3, 0); err != nil {
+		t.Fatalf("Failed to replay - %s", err.Error())
+	}
+
+	// offsets 3, 5 ... are "replay"; the first 100 of them alternate with "other"
+	for i := 1; i < 200; i++ {
+		select {
+		case msg := <-p.Pipe:
+			if msg.Data != fmt.Sprint(i) {
+				t.Fatalf("Unexpected message %d - %#v", i, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting message %d, received none!", i)
+		}
+	}
+}
+
+// readLog reads the data of the log's messages into a string
+func readLog(log *Log, from, to uint64, since int64, t *testing.T) (data string) {
+	err := log.Read(from, to, since, func(msg Message) bool {
+		data += msg.Data
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to read log - %s", err.Error())
+	}
+	return
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,11 +16,45 @@ type (
 		sync.RWMutex
 
 		Authenticated bool
+		Token         string // the token the proxy authenticated with, if any
+		Identity      string // the identity of the proxy's verified client certificate, if any
 		Pipe          chan Message
-		check         chan Message
 		done          chan bool
 		id            uint32
+
+		// messages published to the proxy wait here until they're matched and sent
+		// down the pipe; when it's full, OverflowPolicy decides what gives
+		queue        []Message
+		queueTex     sync.Mutex
+		queued       chan struct{} // signaled when messages are queued
+		dropped      uint64
+		disconnected chan struct{} // closed when the queue overflows under the disconnect policy
+		disconnect   sync.Once
+		replays      []replay  // replays of the log to send before anything queued; guarded by queueTex
+		answers      []Message // requests timed out, answered before anything queued; guarded by queueTex
+
 		subscriptions subscriptions
+		filtered      map[string]filteredSubscription // expression and filtered subscriptions, by how they're listed
+		indexed       []string                        // the tags the proxy is indexed by; guarded by the core mutex
+		requests      map[string]*pendingRequest      // requests waiting on a reply, by their reply tag
+	}
+
+	// filteredSubscription is a subscription that can't be stored in the tree;
+	// one to an expression, or with a filter on the data of the messages it receives
+	filteredSubscription struct {
+		tags   []string // sorted; if the subscription isn't to an expression
+		expr   *Expr
+		filter *Filter
+		allow  func(tags []string) bool
+	}
+
+	// replay is a replay of the message log to a subscription
+	replay struct {
+		sub   filteredSubscription
+		log   *Log
+		from  uint64
+		since int64
+		to    uint64 // the log's next offset when the replay was asked for
 	}
 )
 
@@ -28,10 +64,13 @@ func NewProxy() (p *Proxy) {
 	// create new proxy
 	p = &Proxy{
 		Pipe:          make(chan Message),
-		check:         make(chan Message),
 		done:          make(chan bool),
+		queued:        make(chan struct{}, 1),
+		disconnected:  make(chan struct{}),
 		id:            atomic.AddUint32(&uid, 1),
 		subscriptions: newNode(),
+		filtered:      map[string]filteredSubscription{},
+		requests:      map[string]*pendingRequest{},
 	}
 
 	p.connect()
@@ -51,36 +90,262 @@ func (p *Proxy) connect() {
 func (p *Proxy) handleMessages() {
 
 	defer func() {
-		lumber.Trace("Got p.done, closing check and pipe")
-		close(p.check)
+		lumber.Trace("Got p.done, closing pipe")
 		close(p.Pipe) // don't close pipe (response/pong messages need it), but leaving it unclosed leaves ram bloat on server even after client disconnects
 	}()
 
+	// replays sent since the queue was last empty; messages they sent may also
+	// have been queued, and shouldn't be sent twice
+	replayed := []replay{}
+
 	for {
 		select {
 
 		// we need to ensure that this subscription actually has these tags before
 		// sending anything to it; not doing this will cause everything to come
 		// across the channel
-		case msg := <-p.check:
-			lumber.Trace("Got p.check")
-			p.RLock()
-			match := p.subscriptions.Match(msg.Tags)
-			p.RUnlock()
-
-			// if there is a subscription for the tags publish the message
-			if match {
+		case <-p.queued:
+			for {
+				r, msg, ok := p.next()
+				if !ok {
+					break
+				}
+
+				if r != nil {
+					if !p.sendReplay(*r) {
+						return
+					}
+					replayed = append(replayed, *r)
+					continue
+				}
+				lumber.Trace("Got queued message")
+
+				switch {
+
+				// a timed out request is answered already
+				case msg.Command == "request":
+
+				// a reply to one of the proxy's requests is sent as the answer to it;
+				// replies are only ever queued to the proxy waiting on them, and go
+				// nowhere once it stops waiting
+				case HasReplyTag(msg.Tags):
+					if expired(msg) {
+						dropExpired(msg)
+						continue
+					}
+					answer, ok := p.answer(msg)
+					if !ok {
+						continue
+					}
+					msg = answer
+
+				default:
+					if wasReplayed(replayed, msg) {
+						continue
+					}
+
+					// consumer groups only deliver to members whose subscriptions match
+					p.RLock()
+					match := msg.Group != "" || p.subscriptions.Match(msg.Tags) || p.matchFiltered(msg)
+					p.RUnlock()
+
+					if !match {
+						continue
+					}
+
+					// a message that expired while it was queued is dropped rather than
+					// sent stale; a group stops waiting on it too
+					if expired(msg) {
+						dropExpired(msg)
+						if msg.Group != "" {
+							forget(msg.Group, msg.ID)
+						}
+						continue
+					}
+				}
+
+				// if there is a subscription for the tags publish the message; if the
+				// proxy is closed while nothing is reading the pipe, give up on it
 				lumber.Trace("Sending msg on pipe")
-				p.Pipe <- msg
+				select {
+				case p.Pipe <- msg:
+				case <-p.done:
+					return
+				}
 			}
 
+			// everything queued before the replays were asked for has been seen
+			replayed = replayed[:0]
+
 		case <-p.done:
 			return
 		}
 	}
 }
 
-// Subscribe ...
+// enqueue queues a message published to the proxy without blocking; if the queue
+// is full, the OverflowPolicy decides whether the oldest message or this one is
+// dropped, or the proxy is disconnected
+func (p *Proxy) enqueue(msg Message) {
+	p.queueTex.Lock()
+	if len(p.queue) >= QueueSize {
+		switch OverflowPolicy {
+		case DropNewest:
+			p.queueTex.Unlock()
+			p.drop()
+			return
+		case Disconnect:
+			p.queueTex.Unlock()
+			p.drop()
+			p.overflow()
+			return
+		default:
+			// with no room at all (a queue size under 1) the new message is the one
+			if len(p.queue) == 0 {
+				p.queueTex.Unlock()
+				p.drop()
+				return
+			}
+			p.queue = p.queue[1:]
+			p.drop()
+		}
+	}
+	p.queue = append(p.queue, msg)
+	p.queueTex.Unlock()
+
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the next replay asked for or, if there isn't one, the next timed
+// out request's answer or the oldest queued message; a replay is asked for
+// before anything it should precede is queued
+func (p *Proxy) next() (*replay, Message, bool) {
+	p.queueTex.Lock()
+	defer p.queueTex.Unlock()
+
+	if len(p.replays) != 0 {
+		r := p.replays[0]
+		p.replays = p.replays[1:]
+		return &r, Message{}, true
+	}
+
+	if len(p.answers) != 0 {
+		msg := p.answers[0]
+		p.answers = p.answers[1:]
+		return nil, msg, true
+	}
+
+	msg, ok := p.pop()
+	return nil, msg, ok
+}
+
+// dequeue takes the oldest message off the queue, if there is one
+func (p *Proxy) dequeue() (Message, bool) {
+	p.queueTex.Lock()
+	defer p.queueTex.Unlock()
+
+	return p.pop()
+}
+
+// pop takes the oldest message off the queue; queueTex must be held
+func (p *Proxy) pop() (Message, bool) {
+	if len(p.queue) == 0 {
+		return Message{}, false
+	}
+
+	msg := p.queue[0]
+	p.queue[0] = Message{} // let the message be collected
+	p.queue = p.queue[1:]
+	return msg, true
+}
+
+// sendReplay sends the messages in the log the replay's subscription matches
+// down the pipe, returning false if the proxy is closed while it's sending
+func (p *Proxy) sendReplay(r replay) bool {
+	lumber.Trace("Proxy replaying the log from %d...", r.from)
+
+	closed := false
+	// expired messages are skipped rather than dropped; they're still in the log
+	err := r.log.Read(r.from, r.to, r.since, func(msg Message) bool {
+		if !r.sub.match(msg) || expired(msg) {
+			return true
+		}
+
+		select {
+		case p.Pipe <- msg:
+			return true
+		case <-p.done:
+			closed = true
+			return false
+		}
+	})
+	if err != nil {
+		lumber.Error("Proxy failed to replay the log - %s", err.Error())
+	}
+
+	return !closed
+}
+
+// wasReplayed returns whether [msg] was already sent by one of the [replays]
+func wasReplayed(replays []replay, msg Message) bool {
+	if msg.Offset == 0 {
+		return false
+	}
+
+	for _, r := range replays {
+		if msg.Offset >= r.from && msg.Offset < r.to && msg.Timestamp >= r.since && r.sub.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// drop counts a message dropped from the queue
+func (p *Proxy) drop() {
+	lumber.Trace("Proxy queue full, dropping message")
+	atomic.AddUint64(&p.dropped, 1)
+	atomic.AddUint64(&drops, 1)
+}
+
+// overflow disconnects the proxy for overflowing under the Disconnect policy
+func (p *Proxy) overflow() {
+	p.disconnect.Do(func() {
+		lumber.Debug("Proxy queue overflowed, disconnecting")
+		atomic.AddUint64(&disconnects, 1)
+		close(p.disconnected)
+	})
+}
+
+// Overflow counts a message dropped by whatever buffers the proxy's pipe, once
+// that buffer is full too; under the Disconnect policy the proxy is disconnected
+func (p *Proxy) Overflow() {
+	p.drop()
+	if OverflowPolicy == Disconnect {
+		p.overflow()
+	}
+}
+
+// Disconnected is closed when the proxy's queue overflows under the Disconnect
+// policy; whatever is serving the proxy should disconnect its client
+func (p *Proxy) Disconnected() <-chan struct{} {
+	return p.disconnected
+}
+
+// Overflowed returns whether the proxy was disconnected because its queue overflowed
+func (p *Proxy) Overflowed() bool {
+	select {
+	case <-p.disconnected:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe subscribes to messages with [tags]; the retained messages it matches
+// are sent first
 func (p *Proxy) Subscribe(tags []string) {
 	lumber.Trace("Proxy subscribing to '%s'...", tags)
 
@@ -88,14 +353,14 @@ func (p *Proxy) Subscribe(tags []string) {
 		return
 	}
 
-	// add proxy to subscribers list here so not all clients are 'subscribers'
-	// since gets added to a map, there are no duplicates
-	subscribe(p)
-
 	// add tags to subscription
 	p.Lock()
 	p.subscriptions.Add(tags)
 	p.Unlock()
+
+	// add proxy to subscribers list here so not all clients are 'subscribers'
+	// since gets added to a map, there are no duplicates
+	subscribe(p, filteredSubscription{tags: sortedTags(tags)})
 }
 
 // Unsubscribe ...
@@ -110,44 +375,292 @@ func (p *Proxy) Unsubscribe(tags []string) {
 	p.Lock()
 	p.subscriptions.Remove(tags)
 	p.Unlock()
+
+	resubscribe(p)
+}
+
+// SubscribeFiltered subscribes to messages with [tags] whose data [filter] matches
+func (p *Proxy) SubscribeFiltered(tags []string, filter *Filter) {
+	lumber.Trace("Proxy subscribing to '%s' where '%s'...", tags, filter)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	sub := filteredSubscription{tags: sortedTags(tags), filter: filter}
+
+	p.Lock()
+	p.filtered[sub.String()] = sub
+	p.Unlock()
+
+	subscribe(p, sub)
+}
+
+// UnsubscribeFiltered removes the subscription to [tags] filtered by [filter]
+func (p *Proxy) UnsubscribeFiltered(tags []string, filter *Filter) {
+	lumber.Trace("Proxy unsubscribing from '%s' where '%s'...", tags, filter)
+
+	sub := filteredSubscription{tags: sortedTags(tags), filter: filter}
+
+	p.Lock()
+	delete(p.filtered, sub.String())
+	p.Unlock()
+
+	resubscribe(p)
+}
+
+// SubscribeExpr subscribes to messages whose tags satisfy [expr], and whose data
+// [filter] matches if it isn't nil; if [allow] isn't nil, only the messages it
+// allows are received (what an ACL permits, say)
+func (p *Proxy) SubscribeExpr(expr *Expr, filter *Filter, allow func(tags []string) bool) {
+	lumber.Trace("Proxy subscribing to expression '%s'...", expr)
+
+	sub := filteredSubscription{expr: expr, filter: filter, allow: allow}
+
+	p.Lock()
+	p.filtered[sub.String()] = sub
+	p.Unlock()
+
+	subscribe(p, sub)
+}
+
+// UnsubscribeExpr removes the subscription to [expr] filtered by [filter]
+func (p *Proxy) UnsubscribeExpr(expr *Expr, filter *Filter) {
+	lumber.Trace("Proxy unsubscribing from expression '%s'...", expr)
+
+	sub := filteredSubscription{expr: expr, filter: filter}
+
+	p.Lock()
+	delete(p.filtered, sub.String())
+	p.Unlock()
+
+	resubscribe(p)
+}
+
+// SubscribeGroup subscribes to messages with [tags] (whose data [filter] matches,
+// if it isn't nil) as a member of the [group]; each message goes to one member of
+// the group, and is redelivered until it's acked
+func (p *Proxy) SubscribeGroup(group string, tags []string, filter *Filter) {
+	lumber.Trace("Proxy subscribing to '%s' in group '%s'...", tags, group)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	joinGroup(p, group, filteredSubscription{tags: sortedTags(tags), filter: filter})
+}
+
+// SubscribeGroupExpr subscribes to messages satisfying [expr] as a member of the
+// [group], like SubscribeExpr and SubscribeGroup
+func (p *Proxy) SubscribeGroupExpr(group string, expr *Expr, filter *Filter, allow func(tags []string) bool) {
+	lumber.Trace("Proxy subscribing to expression '%s' in group '%s'...", expr, group)
+
+	joinGroup(p, group, filteredSubscription{expr: expr, filter: filter, allow: allow})
+}
+
+// UnsubscribeGroup leaves the [group], removing all the proxy's subscriptions in
+// it; the messages it hasn't acked are redelivered to other members
+func (p *Proxy) UnsubscribeGroup(group string) {
+	lumber.Trace("Proxy leaving group '%s'...", group)
+
+	leaveGroup(p, group)
+}
+
+// Ack acks the message with [id] the [group] delivered to the proxy
+func (p *Proxy) Ack(group, id string) error {
+	return ackGroup(p, group, id)
+}
+
+// ReplayTags sends the messages in the log with [tags] (whose data [filter]
+// matches, if it isn't nil) from offset [from], or published since [since] in
+// unix nanoseconds, ahead of anything queued. Subscribe to the tags first, and
+// the replay runs straight into live messages without missing or repeating any
+func (p *Proxy) ReplayTags(tags []string, filter *Filter, from uint64, since int64) error {
+	return p.replay(filteredSubscription{tags: sortedTags(tags), filter: filter}, from, since)
+}
+
+// ReplayExpr sends the messages in the log satisfying [expr] (whose data [filter]
+// matches, and [allow] allows, if they aren't nil) like ReplayTags
+func (p *Proxy) ReplayExpr(expr *Expr, filter *Filter, allow func(tags []string) bool, from uint64, since int64) error {
+	return p.replay(filteredSubscription{expr: expr, filter: filter, allow: allow}, from, since)
+}
+
+// replay asks for a replay of the log to [sub], from where the log is now back
+func (p *Proxy) replay(sub filteredSubscription, from uint64, since int64) error {
+	log := DefaultLog
+	if log == nil {
+		return ErrNoLog
+	}
+
+	// with publishing held off, anything published after the replay is asked for
+	// is queued after it
+	mutex.Lock()
+	p.queueTex.Lock()
+	p.replays = append(p.replays, replay{sub: sub, log: log, from: from, since: since, to: log.Next()})
+	p.queueTex.Unlock()
+	mutex.Unlock()
+
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// indexKeys returns the tags the proxy needs to be indexed by; for each of its
+// subscriptions, one of the tags it requires. If any can't be indexed (it has
+// no exact tag it requires) the proxy has to see every message
+func (p *Proxy) indexKeys() (keys []string, all bool) {
+	p.RLock()
+	defer p.RUnlock()
+
+	seen := map[string]bool{}
+	add := func(set []string) {
+		for _, tag := range set {
+			if !IsPattern(tag) && !IsExclusion(tag) {
+				if !seen[tag] {
+					seen[tag] = true
+					keys = append(keys, tag)
+				}
+				return
+			}
+		}
+		all = true
+	}
+
+	for _, set := range p.subscriptions.ToSlice() {
+		add(set)
+	}
+	for _, sub := range p.filtered {
+		if sub.expr != nil {
+			all = true
+			continue
+		}
+		add(sub.tags)
+	}
+
+	return
+}
+
+// matchFiltered returns whether any of the expression or filtered subscriptions
+// match [msg]; tags are checked first, so data is only decoded when they match
+func (p *Proxy) matchFiltered(msg Message) bool {
+	for _, sub := range p.filtered {
+		if sub.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns whether the subscription matches [msg]
+func (sub filteredSubscription) match(msg Message) bool {
+	if sub.expr != nil && !sub.expr.Match(msg.Tags) {
+		return false
+	}
+	if sub.expr == nil && !matchSet(sub.tags, msg.Tags) {
+		return false
+	}
+	if sub.allow != nil && !sub.allow(msg.Tags) {
+		return false
+	}
+
+	return sub.filter == nil || sub.filter.Match(msg.Data)
+}
+
+// list returns the subscription as it's listed; its tags (or expression),
+// followed by its filter
+func (sub filteredSubscription) list() []string {
+	list := sub.tags
+	if sub.expr != nil {
+		list = []string{sub.expr.String()}
+	}
+
+	if sub.filter != nil {
+		list = append(append([]string{}, list...), "WHERE "+sub.filter.String())
+	}
+
+	return list
+}
+
+// String returns the subscription as it's listed, joined
+func (sub filteredSubscription) String() string {
+	return strings.Join(sub.list(), ",")
+}
+
+// sortedTags returns a sorted copy of [tags]
+func sortedTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
 }
 
 // Publish ...
 func (p *Proxy) Publish(tags []string, data string) error {
 	lumber.Trace("Proxy publishing to %s...", tags)
 
-	return publish(p.id, tags, data)
+	_, err := p.PublishMessage(Message{Tags: tags, Data: data})
+	return err
+}
+
+// PublishMessage publishes a message (its tags, data and headers) from the proxy,
+// returning it as it was published; with its ID, Timestamp and Publisher
+func (p *Proxy) PublishMessage(msg Message) (Message, error) {
+	lumber.Trace("Proxy publishing message to %s...", msg.Tags)
+
+	msg.Publisher = p.Identity
+	return publish(p.id, msg)
 }
 
 // PublishAfter sends a message after [delay]
 func (p *Proxy) PublishAfter(tags []string, data string, delay time.Duration) {
-	go func() {
-		<-time.After(delay)
-		if err := publish(p.id, tags, data); err != nil {
-			// log this error and continue
-			lumber.Error("Proxy failed to PublishAfter - %s", err.Error())
-		}
-	}()
+	if _, err := p.ScheduleMessage(Message{Tags: tags, Data: data}, time.Now().Add(delay)); err != nil {
+		// log this error and continue
+		lumber.Error("Proxy failed to PublishAfter - %s", err.Error())
+	}
+}
+
+// ScheduleMessage publishes a message (its tags, data and headers) from the proxy
+// at [at], returning it as it will be published; with its ID, Publisher, and its
+// Timestamp set to [at]
+func (p *Proxy) ScheduleMessage(msg Message, at time.Time) (Message, error) {
+	lumber.Trace("Proxy scheduling message to %s...", msg.Tags)
+
+	msg.Publisher = p.Identity
+	return schedule(p.id, msg, at)
 }
 
-// List returns a list of all current subscriptions
+// List returns a list of all current subscriptions; expression subscriptions are
+// listed as a single tag, the expression, filtered subscriptions end with their
+// filter ("WHERE severity >= 3"), and group subscriptions with their group
+// ("GROUP workers")
 func (p *Proxy) List() (data [][]string) {
 	lumber.Trace("Proxy listing subscriptions...")
 	p.RLock()
 	data = p.subscriptions.ToSlice()
+	for _, sub := range p.filtered {
+		data = append(data, sub.list())
+	}
 	p.RUnlock()
 
-	return
+	return append(data, groupSubscriptions(p)...)
 }
 
 // Close ...
 func (p *Proxy) Close() {
 	lumber.Trace("Proxy closing...")
 
-	if len(p.subscriptions.ToSlice()) != 0 {
-		// remove the local p from mist's list of subscribers
-		unsubscribe(p.id)
+	// remove the local p from mist's list of subscribers (and the index)
+	unsubscribe(p)
+
+	// nobody's waiting on the answers to its requests anymore
+	p.Lock()
+	for tag, req := range p.requests {
+		req.timer.Stop()
+		stopWaiting(tag)
 	}
+	p.Unlock()
 
 	// this closes the goroutine that is matching messages to subscriptions
 	close(p.done)
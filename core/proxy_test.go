@@ -1,6 +1,9 @@
 package core
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 // TestSameSubscriber tests to ensure that mist will not send message to the
 // same proxy who publishes them
@@ -170,3 +173,69 @@ func TestTags(t *testing.T) {
 	sender.Publish([]string{"a", "b"}, testMsg)
 	verifyNoMessage(receiver, t)
 }
+
+// TestQueueOverflow tests that a full queue drops (or disconnects) according to
+// the overflow policy
+func TestQueueOverflow(t *testing.T) {
+	defer func(size int, policy string) { QueueSize, OverflowPolicy = size, policy }(QueueSize, OverflowPolicy)
+	QueueSize = 2
+
+	queue := func(policy string) *Proxy {
+		OverflowPolicy = policy
+
+		// a proxy that nothing takes messages off of
+		p := &Proxy{queued: make(chan struct{}, 1), disconnected: make(chan struct{})}
+		for _, data := range []string{"1", "2", "3", "4"} {
+			p.enqueue(Message{Data: data})
+		}
+		return p
+	}
+
+	dequeued := func(p *Proxy) (data string) {
+		for msg, ok := p.dequeue(); ok; msg, ok = p.dequeue() {
+			data += msg.Data
+		}
+		return
+	}
+
+	if p := queue(DropOldest); dequeued(p) != "34" || p.dropped != 2 {
+		t.Fatalf("Wrong queue for %s - %s", DropOldest, dequeued(p))
+	}
+	if p := queue(DropNewest); dequeued(p) != "12" || p.dropped != 2 || p.Overflowed() {
+		t.Fatalf("Wrong queue for %s", DropNewest)
+	}
+	if p := queue(Disconnect); !p.Overflowed() {
+		t.Fatalf("Expected proxy to be disconnected")
+	}
+
+	QueueSize = 0
+	if p := queue(DropOldest); dequeued(p) != "" || p.dropped != 4 {
+		t.Fatalf("Wrong queue for %s with no room", DropOldest)
+	}
+}
+
+// TestQueueDisconnect tests that a subscriber that can't keep up is disconnected
+// under the disconnect policy
+func TestQueueDisconnect(t *testing.T) {
+	defer func(size int, policy string) { QueueSize, OverflowPolicy = size, policy }(QueueSize, OverflowPolicy)
+	QueueSize, OverflowPolicy = 1, Disconnect
+
+	slow := NewProxy()
+	defer slow.Close()
+	slow.Subscribe([]string{"slow"})
+
+	before := GetStats().Disconnected
+	for i := 0; i < 10; i++ {
+		Publish([]string{"slow"}, testMsg)
+	}
+
+	select {
+	case <-slow.Disconnected():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected slow subscriber to be disconnected")
+	}
+
+	if stats := GetStats(); stats.Disconnected != before+1 || stats.Dropped == 0 {
+		t.Fatalf("Wrong stats - %#v", stats)
+	}
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+const (
+	// ReplyTo is the header a request is published with, naming the tag its reply
+	// is published to
+	ReplyTo = "reply-to"
+
+	// replyPrefix starts every reply tag
+	replyPrefix = "_reply."
+)
+
+var (
+	// RequestTimeout is how long a request without a TTL waits for its reply
+	RequestTimeout = 10 * time.Second
+
+	// ErrRequestTimeout is sent in answer to a request nobody replied to in time
+	ErrRequestTimeout = fmt.Errorf("Failed to request - timed out waiting for a reply")
+
+	// waiting are the proxies waiting on replies, by reply tag; a reply is only
+	// ever delivered to the proxy waiting on it
+	waiting    = map[string]*Proxy{}
+	waitingTex sync.Mutex
+)
+
+// pendingRequest is a request the proxy is waiting on the reply to
+type pendingRequest struct {
+	requestID string // the client's, which its answer is sent with
+	timer     *time.Timer
+}
+
+// Request publishes [msg] from the proxy as a request, with a ReplyTo header
+// naming a private tag the proxy is subscribed to until the request is answered.
+// The first reply published to the tag is sent down the pipe as the answer to
+// the request, a "request" with msg's RequestID; or ErrRequestTimeout if nobody
+// replies within [timeout]. The request expires when its answer is sent, unless
+// it has a TTL of its own
+func (p *Proxy) Request(msg Message, timeout time.Duration) (Message, error) {
+	lumber.Trace("Proxy requesting '%s'...", msg.Tags)
+
+	if len(msg.Tags) == 0 {
+		return msg, fmt.Errorf("Failed to request. Missing tags")
+	}
+
+	if msg.TTL == "" {
+		msg.TTL = timeout.String()
+	}
+	if err := ValidTTL(msg.TTL); err != nil {
+		return msg, err
+	}
+
+	tag, err := newReplyTag()
+	if err != nil {
+		return msg, err
+	}
+
+	headers := map[string]string{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[ReplyTo] = tag
+	msg.Headers = headers
+
+	// waiting before the request is published, so the reply can't be missed; the
+	// reply tag isn't subscribed to, a reply is matched to its request instead
+	p.Lock()
+	p.requests[tag] = &pendingRequest{requestID: msg.RequestID, timer: time.AfterFunc(timeout, func() {
+		p.timeOut(tag)
+	})}
+	p.Unlock()
+
+	waitingTex.Lock()
+	waiting[tag] = p
+	waitingTex.Unlock()
+
+	published, err := p.PublishMessage(msg)
+	if err != nil {
+		p.answer(Message{Tags: []string{tag}})
+		return published, err
+	}
+
+	return published, nil
+}
+
+// answer returns [msg] as the answer to the request whose reply tag it was
+// published to, which stops waiting on it; false if it isn't a reply to one
+func (p *Proxy) answer(msg Message) (Message, bool) {
+	if len(msg.Tags) != 1 {
+		return msg, false
+	}
+
+	req, ok := p.forgetRequest(msg.Tags[0])
+	if !ok {
+		return msg, false
+	}
+	req.timer.Stop()
+
+	msg.Command = "request"
+	msg.RequestID = req.requestID
+	return msg, true
+}
+
+// timeOut gives up on the request waiting on a reply to [tag], answering it with
+// ErrRequestTimeout; the answer isn't queued with published messages, so a full
+// queue can't drop it
+func (p *Proxy) timeOut(tag string) {
+	req, ok := p.forgetRequest(tag)
+	if !ok {
+		return
+	}
+
+	p.queueTex.Lock()
+	p.answers = append(p.answers, Message{Command: "request", RequestID: req.requestID, Tags: []string{tag}, Error: ErrRequestTimeout.Error()})
+	p.queueTex.Unlock()
+
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+}
+
+// forgetRequest stops the proxy waiting on a reply to [tag], returning the
+// request that was; false if none was
+func (p *Proxy) forgetRequest(tag string) (*pendingRequest, bool) {
+	p.Lock()
+	req, ok := p.requests[tag]
+	delete(p.requests, tag)
+	p.Unlock()
+
+	if ok {
+		stopWaiting(tag)
+	}
+	return req, ok
+}
+
+// IsReply returns whether [tags] is the reply tag of a request still waiting on
+// its reply
+func IsReply(tags []string) bool {
+	return len(tags) == 1 && waiter(tags[0]) != nil
+}
+
+// HasReplyTag returns whether any of [tags] is a reply tag (or a pattern that
+// starts like one), whether or not a request is waiting on it
+func HasReplyTag(tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, replyPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// waiter returns the proxy waiting on a reply to [tag], if one is
+func waiter(tag string) *Proxy {
+	waitingTex.Lock()
+	defer waitingTex.Unlock()
+
+	return waiting[tag]
+}
+
+// stopWaiting forgets the proxy waiting on a reply to [tag]
+func stopWaiting(tag string) {
+	waitingTex.Lock()
+	delete(waiting, tag)
+	waitingTex.Unlock()
+}
+
+// newReplyTag returns a tag for replies to a request; random, so nobody else can
+// guess where to reply
+func newReplyTag() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Failed to request - %s", err.Error())
+	}
+	return replyPrefix + hex.EncodeToString(b), nil
+}
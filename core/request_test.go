@@ -0,0 +1,124 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRequest tests that the first reply to a request is sent as the answer to
+// it, and that nobody replying times it out
+func TestRequest(t *testing.T) {
+	requester, responder := NewProxy(), NewProxy()
+	defer requester.Close()
+	defer responder.Close()
+	responder.Subscribe([]string{"rpc"})
+
+	if _, err := requester.Request(Message{Tags: []string{"rpc"}, Data: "ping", TTL: "soon"}, time.Second); err == nil {
+		t.Fatalf("Expected requesting with a bad ttl to fail")
+	}
+
+	if _, err := requester.Request(Message{RequestID: "1", Tags: []string{"rpc"}, Data: "ping"}, time.Second); err != nil {
+		t.Fatalf("Failed to request - %s", err.Error())
+	}
+
+	// the reply tag is only waited on, never subscribed to
+	if list := requester.List(); len(list) != 0 {
+		t.Fatalf("Unexpected subscriptions - %v", list)
+	}
+
+	var req Message
+	select {
+	case req = <-responder.Pipe:
+		if req.Data != "ping" || !IsReply([]string{req.Headers[ReplyTo]}) || req.Expires == 0 {
+			t.Fatalf("Unexpected request - %#v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting request, received none!")
+	}
+
+	// nobody but the requester receives the reply, even subscribed to its tag
+	eavesdropper := NewProxy()
+	defer eavesdropper.Close()
+	eavesdropper.Subscribe([]string{req.Headers[ReplyTo]})
+
+	// only the first reply is the answer
+	responder.Publish([]string{req.Headers[ReplyTo]}, "pong")
+	responder.Publish([]string{req.Headers[ReplyTo]}, "pong again")
+	select {
+	case msg := <-requester.Pipe:
+		if msg.Command != "request" || msg.RequestID != "1" || msg.Data != "pong" || msg.Error != "" {
+			t.Fatalf("Unexpected answer - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting answer, received none!")
+	}
+
+	select {
+	case msg := <-eavesdropper.Pipe:
+		t.Fatalf("Unexpected reply - %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once answered the tag isn't a reply anybody's waiting on
+	if IsReply([]string{req.Headers[ReplyTo]}) {
+		t.Fatalf("Expected the answered request to stop waiting")
+	}
+
+	if _, err := requester.Request(Message{RequestID: "2", Tags: []string{"rpc"}, Data: "ping"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to request - %s", err.Error())
+	}
+	<-responder.Pipe
+
+	select {
+	case msg := <-requester.Pipe:
+		if msg.Command != "request" || msg.RequestID != "2" || msg.Error != ErrRequestTimeout.Error() {
+			t.Fatalf("Unexpected answer - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting timeout, received none!")
+	}
+
+	// the reply tags are unsubscribed once they're answered
+	if list := requester.List(); len(list) != 0 {
+		t.Fatalf("Unexpected subscriptions - %v", list)
+	}
+}
+
+// TestRequestTimeoutOverflow tests that a request times out, and stops waiting,
+// even with its proxy's queue too full to take anything else
+func TestRequestTimeoutOverflow(t *testing.T) {
+	defer func(size int, policy string) { QueueSize, OverflowPolicy = size, policy }(QueueSize, OverflowPolicy)
+	QueueSize, OverflowPolicy = 1, DropNewest
+
+	requester := NewProxy()
+	defer requester.Close()
+	requester.Subscribe([]string{"rpc-full"})
+
+	// one waits on the pipe, one fills the queue
+	Publish([]string{"rpc-full"}, "1")
+	time.Sleep(50 * time.Millisecond)
+	Publish([]string{"rpc-full"}, "2")
+	time.Sleep(50 * time.Millisecond)
+
+	published, err := requester.Request(Message{RequestID: "1", Tags: []string{"rpc-nobody"}, Data: "ping"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to request - %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if IsReply([]string{published.Headers[ReplyTo]}) {
+		t.Fatalf("Expected the timed out request to stop waiting")
+	}
+
+	// the answer isn't queued, so it's sent before what is
+	for _, data := range []string{"1", "", "2"} {
+		select {
+		case msg := <-requester.Pipe:
+			if msg.Data != data || (data == "" && msg.Error != ErrRequestTimeout.Error()) {
+				t.Fatalf("Unexpected message - %#v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting message, received none!")
+		}
+	}
+}
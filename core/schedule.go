@@ -0,0 +1,205 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// scheduled are the messages waiting to be published, by id; guarded by
+	// scheduleTex
+	scheduled   = make(map[string]*scheduledMessage)
+	scheduleTex sync.Mutex
+
+	// schedulePath is the file scheduled messages are saved to, so they survive a
+	// restart; empty when they aren't saved
+	schedulePath string
+)
+
+// scheduledMessage is a message waiting to be published at its Timestamp
+type scheduledMessage struct {
+	msg   Message
+	pid   uint32 // the proxy that scheduled it, which it isn't published to
+	timer *time.Timer
+}
+
+// OpenSchedule saves scheduled messages to the file at [path] from now on, and
+// schedules the messages already saved there; any that came due while the server
+// was down are published straight away
+func OpenSchedule(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read schedule - %s", err.Error())
+	}
+
+	saved := []Message{}
+	if len(b) != 0 {
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return fmt.Errorf("Failed to parse schedule - %s", err.Error())
+		}
+	}
+
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	schedulePath = path
+	for _, msg := range saved {
+		if _, ok := scheduled[msg.ID]; !ok {
+			arm(0, msg)
+		}
+	}
+
+	lumber.Debug("Scheduled %d saved messages", len(saved))
+	return nil
+}
+
+// Schedule publishes a message (its tags, data and headers) to ALL subscribers
+// at [at], returning it as it will be published; with its ID, and its Timestamp
+// set to [at]. The ID is used to cancel it
+func Schedule(msg Message, at time.Time) (Message, error) {
+	lumber.Trace("Scheduling message...")
+	return schedule(0, msg, at)
+}
+
+// Scheduled returns the messages waiting to be published, soonest first; each
+// Timestamp is when it will be
+func Scheduled() []Message {
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	return scheduledMessages()
+}
+
+// CancelScheduled cancels the scheduled message with [id], so it isn't published
+func CancelScheduled(id string) error {
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	s, ok := scheduled[id]
+	if !ok {
+		return fmt.Errorf("Failed to cancel - no scheduled message '%s'", id)
+	}
+
+	s.timer.Stop()
+	delete(scheduled, id)
+
+	if err := saveSchedule(); err != nil {
+		lumber.Error(err.Error())
+	}
+
+	return nil
+}
+
+// schedule schedules [msg] to be published at [at] by the proxy with [pid]; it's
+// saved too, so it isn't lost if the server restarts, and isn't scheduled if it
+// can't be
+func schedule(pid uint32, msg Message, at time.Time) (Message, error) {
+
+	if len(msg.Tags) == 0 {
+		return msg, fmt.Errorf("Failed to schedule. Missing tags")
+	}
+
+	// a ttl counts from when it's published
+	msg, err := expiry(msg, at)
+	if err != nil {
+		return msg, err
+	}
+
+	// the server decides these, whatever the publisher sent
+	msg.Command = "publish"
+	msg.ID = newID()
+	msg.Timestamp = at.UnixNano()
+	msg.RequestID, msg.Filter, msg.Error, msg.Group, msg.Delay = "", "", "", "", ""
+	msg.Offset = 0
+
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	arm(pid, msg)
+	if err := saveSchedule(); err != nil {
+		scheduled[msg.ID].timer.Stop()
+		delete(scheduled, msg.ID)
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+// arm starts the timer that publishes [msg] at its Timestamp; scheduleTex must
+// be held
+func arm(pid uint32, msg Message) {
+	id := msg.ID
+	delay := time.Until(time.Unix(0, msg.Timestamp))
+
+	scheduled[id] = &scheduledMessage{msg: msg, pid: pid, timer: time.AfterFunc(delay, func() { fire(id) })}
+}
+
+// fire publishes the scheduled message with [id], if it hasn't been cancelled;
+// it's published with the ID it was scheduled with
+func fire(id string) {
+	scheduleTex.Lock()
+	s, ok := scheduled[id]
+	if ok {
+		delete(scheduled, id)
+		if err := saveSchedule(); err != nil {
+			lumber.Error(err.Error())
+		}
+	}
+	scheduleTex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if _, err := deliver(s.pid, s.msg); err != nil {
+		lumber.Error("Failed to publish scheduled message '%s' - %s", id, err.Error())
+	}
+}
+
+// scheduledMessages returns the messages waiting to be published, soonest first;
+// scheduleTex must be held
+func scheduledMessages() []Message {
+	msgs := make([]Message, 0, len(scheduled))
+	for _, s := range scheduled {
+		msgs = append(msgs, s.msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Timestamp != msgs[j].Timestamp {
+			return msgs[i].Timestamp < msgs[j].Timestamp
+		}
+		return msgs[i].ID < msgs[j].ID
+	})
+	return msgs
+}
+
+// saveSchedule writes the messages waiting to be published to the schedule file,
+// if there is one; it's replaced whole, so a crash mid-write leaves the last
+// one. scheduleTex must be held
+func saveSchedule() error {
+	if schedulePath == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(scheduledMessages())
+	if err != nil {
+		return fmt.Errorf("Failed to save schedule - %s", err.Error())
+	}
+
+	tmp := schedulePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("Failed to save schedule - %s", err.Error())
+	}
+	if err := os.Rename(tmp, schedulePath); err != nil {
+		return fmt.Errorf("Failed to save schedule - %s", err.Error())
+	}
+
+	return nil
+}
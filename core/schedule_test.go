@@ -0,0 +1,134 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSchedule tests that scheduled messages are listed until they're published,
+// with the id they were scheduled with, or cancelled
+func TestSchedule(t *testing.T) {
+	defer resetSchedule()
+
+	p := NewProxy()
+	defer p.Close()
+	p.Subscribe([]string{"schedule"})
+
+	if _, err := Schedule(Message{Data: testMsg}, time.Now()); err == nil {
+		t.Fatalf("Expected scheduling without tags to fail")
+	}
+
+	soon, err := Schedule(Message{Tags: []string{"schedule"}, Data: "soon"}, time.Now().Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to schedule - %s", err.Error())
+	}
+	later, _ := Schedule(Message{Tags: []string{"schedule"}, Data: "later"}, time.Now().Add(time.Hour))
+
+	if scheduled := Scheduled(); len(scheduled) != 2 || scheduled[0].ID != soon.ID || scheduled[1].ID != later.ID {
+		t.Fatalf("Unexpected scheduled messages - %#v", scheduled)
+	}
+	if stats := GetStats(); stats.Scheduled != 2 {
+		t.Fatalf("Unexpected stats - %#v", stats)
+	}
+
+	if err := CancelScheduled(later.ID); err != nil {
+		t.Fatalf("Failed to cancel - %s", err.Error())
+	}
+	if err := CancelScheduled(later.ID); err == nil {
+		t.Fatalf("Expected cancelling twice to fail")
+	}
+
+	// one that expires before it comes due is dropped
+	expired := GetStats().Expired
+	if _, err := Schedule(Message{Tags: []string{"schedule"}, Data: "stale", TTL: "1ns"}, time.Now()); err != nil {
+		t.Fatalf("Failed to schedule - %s", err.Error())
+	}
+
+	select {
+	case msg := <-p.Pipe:
+		if msg.ID != soon.ID || msg.Data != "soon" {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+
+	// the cancelled message never comes
+	select {
+	case msg := <-p.Pipe:
+		t.Fatalf("Unexpected message - %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if scheduled := Scheduled(); len(scheduled) != 0 {
+		t.Fatalf("Unexpected scheduled messages - %#v", scheduled)
+	}
+	if stats := GetStats(); stats.Expired-expired != 1 {
+		t.Fatalf("Unexpected stats - %#v", stats)
+	}
+}
+
+// TestSchedulePersist tests that scheduled messages are saved, and rescheduled
+// when the schedule is reopened; those that came due meanwhile straight away
+func TestSchedulePersist(t *testing.T) {
+	defer resetSchedule()
+
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	if err := OpenSchedule(path); err != nil {
+		t.Fatalf("Failed to open schedule - %s", err.Error())
+	}
+
+	later, err := Schedule(Message{Tags: []string{"persist"}, Data: "later"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to schedule - %s", err.Error())
+	}
+
+	// a restart
+	resetSchedule()
+	if err := OpenSchedule(path); err != nil {
+		t.Fatalf("Failed to reopen schedule - %s", err.Error())
+	}
+	if scheduled := Scheduled(); len(scheduled) != 1 || scheduled[0].ID != later.ID || scheduled[0].Timestamp != later.Timestamp {
+		t.Fatalf("Unexpected scheduled messages - %#v", scheduled)
+	}
+
+	// a restart after a message came due
+	resetSchedule()
+	due := `[{"command":"publish","id":"due-1","timestamp":1,"tags":["persist"],"data":"due"}]`
+	if err := ioutil.WriteFile(path, []byte(due), 0644); err != nil {
+		t.Fatalf("Failed to write schedule - %s", err.Error())
+	}
+
+	p := NewProxy()
+	defer p.Close()
+	p.Subscribe([]string{"persist"})
+
+	if err := OpenSchedule(path); err != nil {
+		t.Fatalf("Failed to reopen schedule - %s", err.Error())
+	}
+	select {
+	case msg := <-p.Pipe:
+		if msg.ID != "due-1" || msg.Data != "due" {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "[]" {
+		t.Fatalf("Unexpected saved schedule - %s", b)
+	}
+}
+
+// resetSchedule cancels every scheduled message, and stops saving them
+func resetSchedule() {
+	scheduleTex.Lock()
+	for id, s := range scheduled {
+		s.timer.Stop()
+		delete(scheduled, id)
+	}
+	schedulePath = ""
+	scheduleTex.Unlock()
+}
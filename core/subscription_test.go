@@ -252,3 +252,111 @@ func TestMatchComplex(t *testing.T) {
 	node.Remove([]string{"a", "b"})
 	node.Remove([]string{"c", "d"})
 }
+
+// TestMatchPatterns
+func TestMatchPatterns(t *testing.T) {
+	node := newNode()
+
+	// prefix patterns; should match
+	node.Add([]string{"log.*"})
+	if !node.Match([]string{"log.error"}) {
+		t.Fatalf("Expected match!")
+	}
+	if !node.Match([]string{"app", "log.info"}) {
+		t.Fatalf("Expected match!")
+	}
+	if node.Match([]string{"logs"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	node.Remove([]string{"log.*"})
+	if node.Match([]string{"log.error"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// patterns mixed with exact tags need both
+	node.Add([]string{"eu", "tenant:42:*"})
+	if !node.Match([]string{"tenant:42:billing", "eu"}) {
+		t.Fatalf("Expected match!")
+	}
+	if node.Match([]string{"tenant:42:billing"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	if node.Match([]string{"tenant:421:billing", "eu"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	node.Remove([]string{"eu", "tenant:42:*"})
+
+	// patterns anywhere in a tag
+	node.Add([]string{"*.error"})
+	node.Add([]string{"a*c*e"})
+	if !node.Match([]string{"db.error"}) || !node.Match([]string{"abcde"}) || !node.Match([]string{"ace"}) {
+		t.Fatalf("Expected match!")
+	}
+	if node.Match([]string{"db.errors"}) || node.Match([]string{"abcd"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// patterns are listed like any other subscription
+	if len(node.ToSlice()) != 2 {
+		t.Fatalf("Wrong number of subscriptions - Expecting 2 got %d", len(node.ToSlice()))
+	}
+}
+
+// TestMatchSeparateSets tests that sets sharing a branch don't keep the others
+// from matching
+func TestMatchSeparateSets(t *testing.T) {
+	node := newNode()
+
+	node.Add([]string{"a", "x"})
+	node.Add([]string{"b", "c"})
+	if !node.Match([]string{"a", "b", "c"}) {
+		t.Fatalf("Expected match!")
+	}
+}
+
+// TestMatchExclusions
+func TestMatchExclusions(t *testing.T) {
+	node := newNode()
+
+	// everything tagged deploy, except staging
+	node.Add([]string{"deploy", "!staging"})
+	if !node.Match([]string{"deploy"}) || !node.Match([]string{"deploy", "production"}) {
+		t.Fatalf("Expected match!")
+	}
+	if node.Match([]string{"deploy", "staging"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	if node.Match([]string{"staging"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// exclusions only apply to their own set
+	node.Add([]string{"staging"})
+	if !node.Match([]string{"deploy", "staging"}) {
+		t.Fatalf("Expected match!")
+	}
+	node.Remove([]string{"staging"})
+
+	// exclusions can be patterns
+	node.Add([]string{"log.*", "!log.debug*"})
+	if !node.Match([]string{"log.error"}) {
+		t.Fatalf("Expected match!")
+	}
+	if node.Match([]string{"log.debug.verbose"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// and are listed as they were subscribed
+	list := node.ToSlice()
+	if len(list) != 2 {
+		t.Fatalf("Wrong number of subscriptions - Expecting 2 got %d", len(list))
+	}
+	if strings.Join(list[0], ",") != "!staging,deploy" && strings.Join(list[1], ",") != "!staging,deploy" {
+		t.Fatalf("Wrong tags - Expecting '!staging,deploy' got %v", list)
+	}
+
+	node.Remove([]string{"!staging", "deploy"})
+	if node.Match([]string{"deploy"}) {
+		t.Fatalf("Unexpected match!")
+	}
+}
@@ -1,8 +1,17 @@
 package core
 
-import "sort"
+import (
+	"sort"
+	"strings"
+)
 
 type (
+	// subscriptions store sets of tags; a set matches a message when every tag in
+	// it matches one of the message's tags. A tag containing '*' is a pattern,
+	// matching any tag where the '*' can stand for any run of characters
+	// (log.* matches log.error, tenant:42:* matches tenant:42:billing). A tag
+	// starting with '!' is an exclusion; the set doesn't match messages with a tag
+	// it matches (deploy,!staging matches everything tagged deploy but staging)
 	subscriptions interface {
 		Add([]string)
 		Remove([]string)
@@ -16,9 +25,16 @@ type (
 	Node struct {
 		branches map[string]*Node
 		leaves   map[string]struct{}
+		patterns [][]string // sets with patterns or exclusions in them; kept out of the tree so exact matches stay fast
 	}
 )
 
+// NewNode creates a new, empty Node
+func NewNode() *Node {
+	return newNode()
+}
+
+// newNode ...
 func newNode() (node *Node) {
 
 	node = &Node{
@@ -36,6 +52,17 @@ func (node *Node) Add(keys []string) {
 	}
 
 	sort.Strings(keys)
+
+	if !exact(keys) {
+		for _, p := range node.patterns {
+			if equal(p, keys) {
+				return
+			}
+		}
+		node.patterns = append(node.patterns, append([]string{}, keys...))
+		return
+	}
+
 	node.add(keys)
 }
 
@@ -71,6 +98,17 @@ func (node *Node) Remove(keys []string) {
 	}
 
 	sort.Strings(keys)
+
+	if !exact(keys) {
+		for i, p := range node.patterns {
+			if equal(p, keys) {
+				node.patterns = append(node.patterns[:i], node.patterns[i+1:]...)
+				return
+			}
+		}
+		return
+	}
+
 	node.remove(keys)
 }
 
@@ -105,32 +143,37 @@ func (node *Node) remove(keys []string) {
 // Match sorts the keys and then attempts to find a match
 func (node *Node) Match(keys []string) bool {
 	sort.Strings(keys)
-	return node.match(keys)
+	if node.match(keys) {
+		return true
+	}
+
+	// only sets with patterns or exclusions in them need to be checked tag by tag
+	for _, p := range node.patterns {
+		if matchSet(p, keys) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // ​match ...
 func (node *Node) match(keys []string) bool {
-	if len(keys) == 0 {
-		return false
-	}
 
-	// iterate through each key looking for a leaf, if found it's a match
-	for _, key := range keys {
+	// iterate through each key looking for a leaf, if found it's a match; if not,
+	// see if a branch for the key exists and continue down it with the keys after
+	// it, until we find a leaf
+	for i, key := range keys {
 		if _, ok := node.leaves[key]; ok {
 			return true
 		}
-	}
 
-	// see if a branch for the first key exists; if no branch exists we need to
-	// try and find a match for the next key, continuing down the chain until we
-	// find a leaf (above)
-	branch, ok := node.branches[keys[0]]
-	if !ok {
-		return node.match(keys[1:])
+		if branch, ok := node.branches[key]; ok && branch.match(keys[i+1:]) {
+			return true
+		}
 	}
 
-	// if a branch does exist we down the branch until we find a leaf (above)
-	return branch.match(keys[1:])
+	return false
 }
 
 // ToSlice recurses down an entire node returning a list of all branches and leaves
@@ -154,6 +197,11 @@ func (node *Node) ToSlice() (list [][]string) {
 		}
 	}
 
+	// sets with patterns or exclusions are kept separately
+	for _, p := range node.patterns {
+		list = append(list, append([]string{}, p...))
+	}
+
 	// sort each list
 	for _, l := range list {
 		sort.Strings(l)
@@ -161,3 +209,88 @@ func (node *Node) ToSlice() (list [][]string) {
 
 	return
 }
+
+// IsPattern returns whether a tag is a pattern rather than an exact tag
+func IsPattern(tag string) bool {
+	return strings.Contains(tag, "*")
+}
+
+// IsExclusion returns whether a tag excludes the tags it matches rather than
+// requiring one
+func IsExclusion(tag string) bool {
+	return len(tag) > 1 && tag[0] == '!'
+}
+
+// exact returns whether all of the keys are exact tags, so the set can be stored
+// in the tree
+func exact(keys []string) bool {
+	for _, key := range keys {
+		if IsPattern(key) || IsExclusion(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSet returns whether every key in the set matches one of the tags, and
+// none of the exclusions do
+func matchSet(set, tags []string) bool {
+	for _, key := range set {
+		excluded := IsExclusion(key)
+		if excluded {
+			key = key[1:]
+		}
+
+		found := false
+		for _, tag := range tags {
+			if matchTag(key, tag) {
+				found = true
+				break
+			}
+		}
+		if found == excluded {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTag returns whether a tag matches a key, which may be a pattern
+func matchTag(key, tag string) bool {
+	if !IsPattern(key) {
+		return key == tag
+	}
+
+	parts := strings.Split(key, "*")
+
+	// the first part is a prefix and the last a suffix; everything between only
+	// has to appear in order
+	if !strings.HasPrefix(tag, parts[0]) {
+		return false
+	}
+	tag = tag[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(tag, part)
+		if i < 0 {
+			return false
+		}
+		tag = tag[i+len(part):]
+	}
+
+	return len(tag) >= len(last) && strings.HasSuffix(tag, last)
+}
+
+// equal returns whether two sorted sets of keys are the same
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,59 +1,380 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/SteveWXT/pubsub/auth"
 	"github.com/SteveWXT/pubsub/core"
 )
 
 // GenerateHandlers ...
 func GenerateHandlers() map[string]core.HandleFunc {
 	return map[string]core.HandleFunc{
-		"ping":        handlePing,
-		"subscribe":   handleSubscribe,
-		"unsubscribe": handleUnsubscribe,
-		"publish":     handlePublish,
-		// "publishAfter":     handlePublishAfter,
-		"list":    handleList,
-		"listall": handleListAll, // listall related
-		"who":     handleWho,     // who related
+		"auth":         handleAuth,
+		"ping":         handlePing,
+		"subscribe":    handleSubscribe,
+		"unsubscribe":  handleUnsubscribe,
+		"publish":      handlePublish,
+		"publishAfter": handlePublishAfter,
+		"publishAt":    handlePublishAt,
+		"request":      handleRequestReply,
+		"ack":          handleAck,
+		"list":         handleList,
+		"listall":      handleListAll, // listall related
+		"who":          handleWho,     // who related
+		"stats":        handleStats,
+
+		// scheduled messages; publishAfter and publishAt schedule them
+		"schedule.list":   handleScheduleList,
+		"schedule.cancel": handleScheduleCancel,
+
+		// expression subscriptions; the expression is the message data
+		"subscribe.expr":   handleSubscribeExpr,
+		"unsubscribe.expr": handleUnsubscribeExpr,
+
+		// admin commands; these require the master token
+		"token.add":    handleTokenAdd,
+		"token.remove": handleTokenRemove,
+		"token.list":   handleTokenList,
+	}
+}
+
+// handleAuth authenticates the proxy with the token sent as the message data;
+// when no authenticator is configured there is nothing to authenticate against
+func handleAuth(proxy *core.Proxy, msg core.Message) error {
+	if !auth.IsConfigured() {
+		return nil
 	}
+
+	if err := auth.Authenticate(msg.Data); err != nil {
+		return err
+	}
+
+	proxy.Authenticated = true
+	proxy.Token = msg.Data
+
+	return nil
+}
+
+// authenticate is run against every message an unauthenticated connection sends;
+// the only thing such a connection is allowed to do is authenticate
+func authenticate(proxy *core.Proxy, msg core.Message) error {
+	if msg.Command != "auth" {
+		return auth.ErrUnauthorized
+	}
+
+	return handleAuth(proxy, msg)
 }
 
 // handlePing
 func handlePing(proxy *core.Proxy, msg core.Message) error {
 	// goroutining any of these would allow a client to spam and overwhelm the server. clients don't need the ability to ping indefinitely
-	proxy.Pipe <- core.Message{Command: "ping", Tags: []string{}, Data: "pong"}
+	proxy.Pipe <- core.Message{Command: "ping", RequestID: msg.RequestID, Tags: []string{}, Data: "pong"}
 	return nil
 }
 
 // handleSubscribe
 func handleSubscribe(proxy *core.Proxy, msg core.Message) error {
-	proxy.Subscribe(msg.Tags)
+	if len(msg.Tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	if err := allowSubscribe(proxy.Token, proxy.Identity, msg.Tags); err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(msg.Filter)
+	if err != nil {
+		return err
+	}
+
+	if replaying(msg) && (core.DefaultLog == nil || msg.Group != "") {
+		return replayError(msg)
+	}
+
+	if msg.Group != "" {
+		proxy.SubscribeGroup(msg.Group, msg.Tags, filter)
+		ack(proxy, msg)
+		return nil
+	}
+
+	// subscribing before replaying means nothing is missed in between
+	subscribeFiltered(proxy, msg.Tags, filter)
+	if replaying(msg) {
+		if err := proxy.ReplayTags(msg.Tags, filter, msg.Offset, msg.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	ack(proxy, msg)
 	return nil
 }
 
 // handleUnsubscribe
 func handleUnsubscribe(proxy *core.Proxy, msg core.Message) error {
-	proxy.Unsubscribe(msg.Tags)
+	// a group is left by name, whatever it was subscribed to
+	if len(msg.Tags) == 0 && msg.Group == "" {
+		return fmt.Errorf("Unable to unsubscribe - missing tags")
+	}
+
+	filter, err := parseFilter(msg.Filter)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case msg.Group != "":
+		proxy.UnsubscribeGroup(msg.Group)
+	case filter != nil:
+		proxy.UnsubscribeFiltered(msg.Tags, filter)
+	default:
+		proxy.Unsubscribe(msg.Tags)
+	}
+
+	ack(proxy, msg)
+	return nil
+}
+
+// handleSubscribeExpr subscribes to the expression sent as the message data; an
+// ACL limits the messages it receives, rather than whether it can subscribe
+func handleSubscribeExpr(proxy *core.Proxy, msg core.Message) error {
+	expr, err := core.ParseExpr(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(msg.Filter)
+	if err != nil {
+		return err
+	}
+
+	allow, err := auth.SubscribeFilter(proxy.Token, proxy.Identity)
+	if err != nil {
+		return err
+	}
+
+	if replaying(msg) && (core.DefaultLog == nil || msg.Group != "") {
+		return replayError(msg)
+	}
+
+	if msg.Group != "" {
+		proxy.SubscribeGroupExpr(msg.Group, expr, filter, allow)
+		ack(proxy, msg)
+		return nil
+	}
+
+	proxy.SubscribeExpr(expr, filter, allow)
+	if replaying(msg) {
+		if err := proxy.ReplayExpr(expr, filter, allow, msg.Offset, msg.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	ack(proxy, msg)
+	return nil
+}
+
+// handleUnsubscribeExpr unsubscribes from the expression sent as the message data
+func handleUnsubscribeExpr(proxy *core.Proxy, msg core.Message) error {
+	expr, err := core.ParseExpr(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseFilter(msg.Filter)
+	if err != nil {
+		return err
+	}
+
+	if msg.Group != "" {
+		proxy.UnsubscribeGroup(msg.Group)
+	} else {
+		proxy.UnsubscribeExpr(expr, filter)
+	}
+
+	ack(proxy, msg)
 	return nil
 }
 
 // handlePublish
 func handlePublish(proxy *core.Proxy, msg core.Message) error {
-	proxy.Publish(msg.Tags, msg.Data)
+	if err := allowPublish(proxy.Token, proxy.Identity, msg.Tags); err != nil {
+		return err
+	}
+
+	published, err := proxy.PublishMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// the ack tells the publisher the id and timestamp its message was given, and
+	// when it expires
+	proxy.Pipe <- core.Message{Command: "publish", RequestID: msg.RequestID, ID: published.ID, Timestamp: published.Timestamp, Expires: published.Expires, Tags: msg.Tags, Data: "success"}
+	return nil
+}
+
+// handleRequestReply publishes the message as a request, with a reply-to header; the
+// first reply to it is sent as the answer, or an error if there's none within
+// its TTL (or core.RequestTimeout). See core.Proxy.Request
+func handleRequestReply(proxy *core.Proxy, msg core.Message) error {
+	if err := allowPublish(proxy.Token, proxy.Identity, msg.Tags); err != nil {
+		return err
+	}
+
+	if err := core.ValidTTL(msg.TTL); err != nil {
+		return err
+	}
+
+	timeout := core.RequestTimeout
+	if msg.TTL != "" {
+		timeout, _ = time.ParseDuration(msg.TTL)
+	}
+
+	_, err := proxy.Request(msg, timeout)
+	return err
+}
+
+// allowPublish returns an error if the connection may not publish to [tags];
+// anyone may reply to a request waiting on its reply, as only those it was sent
+// to know where, but reply tags can't be published to otherwise
+func allowPublish(token, identity string, tags []string) error {
+	switch {
+	case core.IsReply(tags):
+		return nil
+	case core.HasReplyTag(tags):
+		return fmt.Errorf("Forbidden - no request is waiting on a reply to '%s'", strings.Join(tags, ","))
+	}
+
+	return auth.AllowPublish(token, identity, tags)
+}
+
+// allowSubscribe returns an error if the connection may not subscribe to [tags];
+// reply tags are only subscribed to by the request waiting on them
+func allowSubscribe(token, identity string, tags []string) error {
+	if core.HasReplyTag(tags) {
+		return fmt.Errorf("Forbidden - reply tags are only received by the request waiting on them")
+	}
+
+	return auth.AllowSubscribe(token, identity, tags)
+}
+
+// handleAck acks the message with the message's ID, delivered by its Group, so
+// the group doesn't redeliver it
+func handleAck(proxy *core.Proxy, msg core.Message) error {
+	if msg.Group == "" || msg.ID == "" {
+		return fmt.Errorf("Unable to ack - missing group or id")
+	}
+
+	if err := proxy.Ack(msg.Group, msg.ID); err != nil {
+		return err
+	}
+
+	ack(proxy, msg)
+	return nil
+}
+
+// replayError explains why a subscribe can't replay the message log
+func replayError(msg core.Message) error {
+	if msg.Group != "" {
+		return fmt.Errorf("Failed to replay - consumer groups can't replay the message log")
+	}
+	return core.ErrNoLog
+}
+
+// replaying returns whether a subscribe asks to replay the message log, from an
+// offset or a time
+func replaying(msg core.Message) bool {
+	return msg.Offset != 0 || msg.Timestamp != 0
+}
+
+// ack acknowledges a command that succeeded; one that fails is answered with its
+// error instead
+func ack(proxy *core.Proxy, msg core.Message) {
+	proxy.Pipe <- core.Message{Command: msg.Command, RequestID: msg.RequestID, Tags: msg.Tags, Data: "success"}
+}
+
+// handlePublishAfter schedules the message to be published after its Delay
+func handlePublishAfter(proxy *core.Proxy, msg core.Message) error {
+	delay, err := time.ParseDuration(msg.Delay)
+	if err != nil || delay < 0 {
+		return fmt.Errorf("Unable to schedule - bad delay '%s'; expecting a duration like 10s", msg.Delay)
+	}
+
+	return schedule(proxy, msg, time.Now().Add(delay))
+}
+
+// handlePublishAt schedules the message to be published at its Timestamp
+func handlePublishAt(proxy *core.Proxy, msg core.Message) error {
+	if msg.Timestamp == 0 {
+		return fmt.Errorf("Unable to schedule - missing timestamp")
+	}
+
+	return schedule(proxy, msg, time.Unix(0, msg.Timestamp))
+}
+
+// schedule schedules the message to be published at [at]; the ack tells the
+// publisher the id to cancel it with, and when it will be published
+func schedule(proxy *core.Proxy, msg core.Message, at time.Time) error {
+	if err := allowPublish(proxy.Token, proxy.Identity, msg.Tags); err != nil {
+		return err
+	}
+
+	scheduled, err := proxy.ScheduleMessage(msg, at)
+	if err != nil {
+		return err
+	}
+
+	proxy.Pipe <- core.Message{Command: msg.Command, RequestID: msg.RequestID, ID: scheduled.ID, Timestamp: scheduled.Timestamp, Expires: scheduled.Expires, Tags: msg.Tags, Data: "success"}
 	return nil
 }
 
-// handlePublishAfter - how do we get the [delay] here?
-// func handlePublishAfter(proxy *core.Proxy, msg core.Message) error {
-// 	proxy.PublishAfter(msg.Tags, msg.Data, ???)
-// 	go func() {
-// 		proxy.Pipe <- core.Message{Command: "publish after", Tags: msg.Tags, Data: "success"}
-// 	}()
-// 	return nil
-// }
+// handleScheduleList lists the scheduled messages the proxy could have published
+// itself, as json
+func handleScheduleList(proxy *core.Proxy, msg core.Message) error {
+	scheduled := []core.Message{}
+	for _, s := range core.Scheduled() {
+		if auth.AllowPublish(proxy.Token, proxy.Identity, s.Tags) == nil {
+			scheduled = append(scheduled, s)
+		}
+	}
+
+	b, err := json.Marshal(scheduled)
+	if err != nil {
+		return fmt.Errorf("Failed to encode scheduled messages - %s", err.Error())
+	}
+
+	proxy.Pipe <- core.Message{Command: "schedule.list", RequestID: msg.RequestID, Data: string(b)}
+	return nil
+}
+
+// handleScheduleCancel cancels the scheduled message with the message's ID; only
+// a proxy that could have published it itself may cancel it
+func handleScheduleCancel(proxy *core.Proxy, msg core.Message) error {
+	if msg.ID == "" {
+		return fmt.Errorf("Unable to cancel - missing id")
+	}
+
+	for _, s := range core.Scheduled() {
+		if s.ID != msg.ID {
+			continue
+		}
+
+		if err := auth.AllowPublish(proxy.Token, proxy.Identity, s.Tags); err != nil {
+			return err
+		}
+		if err := core.CancelScheduled(s.ID); err != nil {
+			return err
+		}
+
+		proxy.Pipe <- core.Message{Command: "schedule.cancel", RequestID: msg.RequestID, ID: msg.ID, Data: "success"}
+		return nil
+	}
+
+	return fmt.Errorf("Failed to cancel - no scheduled message '%s'", msg.ID)
+}
 
 // handleList
 func handleList(proxy *core.Proxy, msg core.Message) error {
@@ -61,14 +382,20 @@ func handleList(proxy *core.Proxy, msg core.Message) error {
 	for _, v := range proxy.List() {
 		subscriptions += strings.Join(v, ",")
 	}
-	proxy.Pipe <- core.Message{Command: "list", Tags: msg.Tags, Data: subscriptions}
+	proxy.Pipe <- core.Message{Command: "list", RequestID: msg.RequestID, Tags: msg.Tags, Data: subscriptions}
 	return nil
 }
 
-// handleListAll - listall related
+// handleListAll - listall related; only what the proxy could subscribe to itself
+// is listed
 func handleListAll(proxy *core.Proxy, msg core.Message) error {
-	subscriptions := core.Subscribers()
-	proxy.Pipe <- core.Message{Command: "listall", Tags: msg.Tags, Data: subscriptions}
+	allow, err := auth.SubscribeFilter(proxy.Token, proxy.Identity)
+	if err != nil {
+		return err
+	}
+
+	subscriptions := strings.Join(core.Subscribers(allow), " ")
+	proxy.Pipe <- core.Message{Command: "listall", RequestID: msg.RequestID, Tags: msg.Tags, Data: subscriptions}
 	return nil
 }
 
@@ -76,6 +403,123 @@ func handleListAll(proxy *core.Proxy, msg core.Message) error {
 func handleWho(proxy *core.Proxy, msg core.Message) error {
 	who, max := core.Who()
 	subscribers := fmt.Sprintf("Lifetime  connections: %d\nSubscribers connected: %d", max, who)
-	proxy.Pipe <- core.Message{Command: "who", Tags: msg.Tags, Data: subscribers}
+	if identities := core.Identities(); len(identities) != 0 {
+		subscribers += fmt.Sprintf("\nSubscriber identities: %s", strings.Join(identities, ", "))
+	}
+	proxy.Pipe <- core.Message{Command: "who", RequestID: msg.RequestID, Tags: msg.Tags, Data: subscribers}
+	return nil
+}
+
+// handleStats replies with message delivery stats as json
+func handleStats(proxy *core.Proxy, msg core.Message) error {
+	b, err := json.Marshal(core.GetStats())
+	if err != nil {
+		return fmt.Errorf("Failed to encode stats - %s", err.Error())
+	}
+
+	proxy.Pipe <- core.Message{Command: "stats", RequestID: msg.RequestID, Data: string(b)}
+	return nil
+}
+
+// tokenAdmin returns the authenticator whose tokens the proxy manages; only a
+// proxy authenticated with the master token may, and only if there is one
+func tokenAdmin(proxy *core.Proxy) (auth.Authenticator, error) {
+	if !auth.IsMaster(proxy.Token) {
+		return nil, auth.ErrNotAdmin
+	}
+
+	authenticator := auth.Default()
+	if authenticator == nil {
+		return nil, auth.ErrNotConfigured
+	}
+
+	return authenticator, nil
+}
+
+// handleTokenAdd adds the token (and its ACL) json encoded in the message data;
+// or, for a certificate identity, sets its ACL
+func handleTokenAdd(proxy *core.Proxy, msg core.Message) error {
+	authenticator, err := tokenAdmin(proxy)
+	if err != nil {
+		return err
+	}
+
+	token := auth.Token{}
+	if err := json.Unmarshal([]byte(msg.Data), &token); err != nil {
+		return fmt.Errorf("Failed to parse token - %s", err.Error())
+	}
+
+	switch {
+	case token.Identity == "":
+		if err := authenticator.AddToken(token.Token, token.ACL); err != nil {
+			return err
+		}
+	case token.Token != "":
+		return fmt.Errorf("Unable to add token - expecting a token or an identity, not both")
+	case token.ACL == nil:
+		return fmt.Errorf("Unable to add identity - missing ACL; identities are unrestricted without one")
+	default:
+		if err := authenticator.SetIdentityACL(token.Identity, token.ACL); err != nil {
+			return err
+		}
+	}
+
+	proxy.Pipe <- core.Message{Command: "token.add", RequestID: msg.RequestID, Data: "success"}
+	return nil
+}
+
+// handleTokenRemove removes the token sent as the message data; or the ACL of a
+// certificate identity, sent json encoded like token.add
+func handleTokenRemove(proxy *core.Proxy, msg core.Message) error {
+	authenticator, err := tokenAdmin(proxy)
+	if err != nil {
+		return err
+	}
+
+	if err := removeToken(authenticator, msg.Data); err != nil {
+		return err
+	}
+
+	proxy.Pipe <- core.Message{Command: "token.remove", RequestID: msg.RequestID, Data: "success"}
+	return nil
+}
+
+// removeToken removes the token [data]; or the ACL of the identity, if it's a
+// json encoded auth.Token with one
+func removeToken(authenticator auth.Authenticator, data string) error {
+	token := auth.Token{}
+	if err := json.Unmarshal([]byte(data), &token); err != nil || token.Identity == "" {
+		return authenticator.RemoveToken(data)
+	}
+
+	acl, err := authenticator.IdentityACL(token.Identity)
+	if err != nil {
+		return err
+	}
+	if acl == nil {
+		return auth.ErrIdentityNotFound
+	}
+
+	return authenticator.SetIdentityACL(token.Identity, nil)
+}
+
+// handleTokenList lists every token (and its ACL) as json
+func handleTokenList(proxy *core.Proxy, msg core.Message) error {
+	authenticator, err := tokenAdmin(proxy)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := authenticator.Tokens()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("Failed to encode tokens - %s", err.Error())
+	}
+
+	proxy.Pipe <- core.Message{Command: "token.list", RequestID: msg.RequestID, Data: string(b)}
 	return nil
 }
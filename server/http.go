@@ -1,21 +1,48 @@
 package server
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/jcelliott/lumber"
+
+	"github.com/SteveWXT/pubsub/auth"
+	"github.com/SteveWXT/pubsub/core"
 )
 
 var (
 	// Router ...
 	Router = pat.New()
+
+	// routed registers the api routes with the Router once, however many http and
+	// https listeners serve it
+	routed sync.Once
+
+	// EventsKeepAlive is how often an idle server-sent events stream is sent a
+	// comment to keep it from being closed
+	EventsKeepAlive = 15 * time.Second
 )
 
 // init adds http/https as available mist server types
 func init() {
-	Register("http", StartHTTP)
+	Register("http", func(url *url.URL, errChan chan<- error) {
+		StartHTTP(url.Host, errChan)
+	})
+	Register("https", func(url *url.URL, errChan chan<- error) {
+		config, err := tlsConfig(url)
+		if err != nil {
+			errChan <- fmt.Errorf("Unable to start mist https listener - %s", err.Error())
+			return
+		}
+		StartHTTPS(url.Host, config, errChan)
+	})
 }
 
 // StartHTTP starts a mist server listening over HTTP
@@ -25,6 +52,13 @@ func StartHTTP(uri string, errChan chan<- error) {
 	}
 }
 
+// StartHTTPS starts a mist server listening over HTTPS
+func StartHTTPS(uri string, config *tls.Config, errChan chan<- error) {
+	if err := newHTTPS(uri, config); err != nil {
+		errChan <- fmt.Errorf("Unable to start mist https listener - %s", err.Error())
+	}
+}
+
 func newHTTP(address string) error {
 	lumber.Info("HTTP server listening at '%s'...\n", address)
 
@@ -32,22 +66,274 @@ func newHTTP(address string) error {
 	return http.ListenAndServe(address, routes())
 }
 
-// routes registers all api routes with the router
+func newHTTPS(address string, config *tls.Config) error {
+	lumber.Info("HTTPS server listening at '%s'...\n", address)
+
+	server := &http.Server{Addr: address, Handler: routes(), TLSConfig: config}
+
+	// blocking...
+	return server.ListenAndServeTLS("", "")
+}
+
+// routes registers all api routes with the router, the first time it's called;
+// routes are matched as prefixes, in the order they're registered
 func routes() *pat.Router {
-	Router.Get("/ping", func(rw http.ResponseWriter, req *http.Request) {
-		rw.Write([]byte("pong\n"))
+	routed.Do(func() {
+		Router.Get("/ping", func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("pong\n"))
+		})
+		Router.Get("/subscribe/events", handleRequest(subscribeEvents))
+		Router.Get("/subscribe/poll/{id}", handleRequest(poll))
+		Router.Delete("/subscribe/poll/{id}", handleRequest(unsubscribePoll))
+		Router.Post("/subscribe/poll", handleRequest(subscribePoll))
+		Router.Post("/publish", handleRequest(publish))
+		Router.Get("/listall", handleRequest(listAll))
+		Router.Get("/list", handleRequest(list))
+		Router.Get("/who", handleRequest(who))
+		Router.Get("/stats", handleRequest(stats))
 	})
-	// Router.Get("/list", handleRequest(list))
-	// Router.Get("/subscribe", handleRequest(subscribe))
-	// Router.Get("/unsubscribe", handleRequest(unsubscribe))
 
 	return Router
 }
 
-// handleRequest is a wrapper for the actual route handler, simply to provide some
-// debug output
+// handleRequest is a wrapper for the actual route handler, to provide some debug
+// output and to turn away unauthenticated requests
 func handleRequest(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
+		lumber.Trace("HTTP Running '%s %s'...", req.Method, req.URL.Path)
+
+		if auth.IsConfigured() && reqIdentity(req) == "" {
+			if err := auth.Authenticate(authToken(req)); err != nil {
+				writeError(rw, http.StatusUnauthorized, err)
+				return
+			}
+		}
+
 		fn(rw, req)
 	}
 }
+
+// publish publishes the tags and data of a json message to all subscribers
+func publish(rw http.ResponseWriter, req *http.Request) {
+	msg := core.Message{}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("Failed to parse message - %s", err.Error()))
+		return
+	}
+
+	if len(msg.Tags) == 0 {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("Unable to publish - missing tags"))
+		return
+	}
+
+	if err := core.ValidTTL(msg.TTL); err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := allowPublish(authToken(req), reqIdentity(req), msg.Tags); err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+
+	msg.Publisher = reqIdentity(req)
+	published, err := core.PublishMessage(msg)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeBody(rw, http.StatusOK, core.Message{Command: "publish", ID: published.ID, Timestamp: published.Timestamp, Expires: published.Expires, Tags: msg.Tags, Data: "success"})
+}
+
+// list responds with every tag set subscribers are subscribed to, that the
+// requester could subscribe to itself
+func list(rw http.ResponseWriter, req *http.Request) {
+	allow, err := auth.SubscribeFilter(authToken(req), reqIdentity(req))
+	if err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+
+	writeBody(rw, http.StatusOK, core.Subscriptions(allow))
+}
+
+// listAll responds with every tag subscribers are subscribed to, that the
+// requester could subscribe to itself
+func listAll(rw http.ResponseWriter, req *http.Request) {
+	allow, err := auth.SubscribeFilter(authToken(req), reqIdentity(req))
+	if err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+
+	writeBody(rw, http.StatusOK, core.Subscribers(allow))
+}
+
+// who responds with connection/subscriber stats
+func who(rw http.ResponseWriter, req *http.Request) {
+	subscribers, lifetime := core.Who()
+	writeBody(rw, http.StatusOK, map[string]int{"lifetime": lifetime, "subscribers": subscribers})
+}
+
+// stats responds with message delivery stats
+func stats(rw http.ResponseWriter, req *http.Request) {
+	writeBody(rw, http.StatusOK, core.GetStats())
+}
+
+// subscribeEvents subscribes to the comma delimited tags in the query and streams
+// every message published to them as server-sent events, until the client goes
+// away (GET /subscribe/events?tags=a,b&filter=severity>=3)
+func subscribeEvents(rw http.ResponseWriter, req *http.Request) {
+	tags := queryTags(req)
+	if len(tags) == 0 {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("Unable to subscribe - missing tags"))
+		return
+	}
+
+	if err := allowSubscribe(authToken(req), reqIdentity(req), tags); err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+
+	filter, err := parseFilter(req.FormValue("filter"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("Streaming unsupported"))
+		return
+	}
+
+	proxy := core.NewProxy()
+	defer proxy.Close()
+
+	subscribeFiltered(proxy, tags, filter)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// proxies close idle connections, so every so often a comment is sent to keep
+	// the stream alive
+	keepAlive := time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg, ok := <-proxy.Pipe:
+			if !ok {
+				return
+			}
+
+			b, err := json.Marshal(msg)
+			if err != nil {
+				lumber.Error("HTTP Failed to encode event - %s", err.Error())
+				continue
+			}
+
+			// published messages have an id, which the client reports as the last
+			// event id it saw
+			if msg.ID != "" {
+				if _, err := fmt.Fprintf(rw, "id: %s\n", msg.ID); err != nil {
+					return
+				}
+			}
+			if _, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", msg.Command, b); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		// the client went away
+		case <-req.Context().Done():
+			lumber.Debug("HTTP Events client disconnected")
+			return
+
+		// the client can't keep up with what it's subscribed to
+		case <-proxy.Disconnected():
+			lumber.Debug("HTTP Events client queue overflowed, disconnecting")
+			return
+		}
+	}
+}
+
+// queryTags returns the tags of a request's query; tags can be comma delimited
+// (?tags=a,b) and/or repeated (?tags=a&tags=b)
+func queryTags(req *http.Request) (tags []string) {
+	for _, v := range req.URL.Query()["tags"] {
+		for _, tag := range strings.Split(v, ",") {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return
+}
+
+// authToken returns the token a request was made with, either from the
+// X-Auth-Token header or the x-auth-token query param
+func authToken(req *http.Request) string {
+	if token := req.Header.Get("X-Auth-Token"); token != "" {
+		return token
+	}
+
+	return req.FormValue("x-auth-token")
+}
+
+// parseFilter parses a subscription's filter, if it has one
+func parseFilter(filter string) (*core.Filter, error) {
+	if filter == "" {
+		return nil, nil
+	}
+
+	return core.ParseFilter(filter)
+}
+
+// subscribeFiltered subscribes a proxy to [tags], filtered by [filter] if it
+// isn't nil
+func subscribeFiltered(proxy *core.Proxy, tags []string, filter *core.Filter) {
+	if filter != nil {
+		proxy.SubscribeFiltered(tags, filter)
+		return
+	}
+
+	proxy.Subscribe(tags)
+}
+
+// reqIdentity returns the identity of a request's verified client certificate, if
+// it presented one
+func reqIdentity(req *http.Request) string {
+	return certIdentity(req.TLS)
+}
+
+// writeBody json encodes [v] as the response body
+func writeBody(rw http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		lumber.Error("HTTP Failed to encode response - %s", err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(append(b, '\n'))
+}
+
+// writeError responds with [err] in the error field of a json body
+func writeError(rw http.ResponseWriter, status int, err error) {
+	lumber.Debug("HTTP Failed request - %s", err.Error())
+	writeBody(rw, status, map[string]string{"error": err.Error()})
+}
@@ -1,10 +1,15 @@
 package server_test
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/SteveWXT/pubsub/core"
 	"github.com/SteveWXT/pubsub/server"
 )
 
@@ -14,8 +19,126 @@ func TestHTTPStart(t *testing.T) {
 
 	go func() {
 		if err := server.Start([]string{"http://127.0.0.1:8080"}); err != nil {
-			t.Fatalf("Unexpected error - %s", err.Error())
+			t.Errorf("Unexpected error - %s", err.Error())
 		}
 	}()
 	<-time.After(time.Second)
 }
+
+// TestHTTPAPI tests the publish, list, listall and who routes against the
+// server started above
+func TestHTTPAPI(t *testing.T) {
+	proxy := core.NewProxy()
+	defer proxy.Close()
+	proxy.Subscribe([]string{"http"})
+
+	// publish should reach subscribers
+	res, err := http.Post("http://127.0.0.1:8080/publish", "application/json", strings.NewReader(`{"tags":["http"],"data":"hello"}`))
+	if err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+	select {
+	case msg := <-proxy.Pipe:
+		if msg.Data != "hello" {
+			t.Fatalf("Unexpected data - %s", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+
+	// publishing without tags should fail
+	res, err = http.Post("http://127.0.0.1:8080/publish", "application/json", strings.NewReader(`{"data":"hello"}`))
+	if err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+
+	subscriptions := [][]string{}
+	getJSON("http://127.0.0.1:8080/list", &subscriptions, t)
+	if !strings.Contains(fmt.Sprint(subscriptions), "[http]") {
+		t.Fatalf("Missing subscription - %v", subscriptions)
+	}
+
+	tags := []string{}
+	getJSON("http://127.0.0.1:8080/listall", &tags, t)
+	if !strings.Contains(strings.Join(tags, " "), "http") {
+		t.Fatalf("Missing tag - %v", tags)
+	}
+
+	stats := map[string]int{}
+	getJSON("http://127.0.0.1:8080/who", &stats, t)
+	if stats["subscribers"] < 1 || stats["lifetime"] < 1 {
+		t.Fatalf("Unexpected stats - %v", stats)
+	}
+
+	delivery := core.Stats{}
+	getJSON("http://127.0.0.1:8080/stats", &delivery, t)
+	if delivery.QueueSize != core.QueueSize || delivery.OverflowPolicy != core.OverflowPolicy {
+		t.Fatalf("Unexpected stats - %#v", delivery)
+	}
+}
+
+// getJSON decodes the json body of a GET request into [v]
+func getJSON(url string, v interface{}, t *testing.T) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to GET '%s' - %s", url, err.Error())
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("Failed to decode '%s' - %s", url, err.Error())
+	}
+}
+
+// TestHTTPEvents tests that published messages are streamed as server-sent events
+func TestHTTPEvents(t *testing.T) {
+	res, err := http.Get("http://127.0.0.1:8080/subscribe/events?tags=sse")
+	if err != nil {
+		t.Fatalf("Failed to subscribe - %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected content type - %s", res.Header.Get("Content-Type"))
+	}
+
+	// the subscription is made before the response headers are sent
+	core.Publish([]string{"sse"}, "hello")
+
+	reader := bufio.NewReader(res.Body)
+	id, _ := reader.ReadString('\n')
+	event, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+	if event != "event: publish\n" {
+		t.Fatalf("Unexpected event - %q", event)
+	}
+
+	msg := core.Message{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &msg); err != nil {
+		t.Fatalf("Failed to decode event data %q - %s", data, err.Error())
+	}
+	if msg.Data != "hello" {
+		t.Fatalf("Unexpected data - %s", msg.Data)
+	}
+	if msg.ID == "" || id != "id: "+msg.ID+"\n" {
+		t.Fatalf("Unexpected event id - %q", id)
+	}
+
+	// subscribing without tags should fail
+	res, err = http.Get("http://127.0.0.1:8080/subscribe/events")
+	if err != nil {
+		t.Fatalf("Failed to subscribe - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/SteveWXT/pubsub/core"
+)
+
+var (
+	// PollTimeout is the longest a poll will block waiting for messages
+	PollTimeout = 30 * time.Second
+
+	// PollIdleTimeout is how long a long-poll subscription can go without being
+	// polled before it's closed
+	PollIdleTimeout = 2 * time.Minute
+
+	// PollBufferSize is the most messages a long-poll subscription will buffer
+	// between polls; once full the overflow policy decides whether the oldest
+	// message or the newest is dropped, or the subscription is closed
+	PollBufferSize = 1000
+
+	// long-poll subscriptions by id
+	pollers    = map[string]*poller{}
+	pollersTex sync.Mutex
+	reaper     sync.Once
+)
+
+type (
+	// poller is a long-poll subscription; a proxy that lives across requests and
+	// buffers the messages published to it until they're polled
+	poller struct {
+		sync.Mutex
+
+		id       string
+		token    string // the token the subscription was made with
+		identity string // the client certificate identity the subscription was made with
+		proxy    *core.Proxy
+		messages []core.Message
+		notify   chan struct{} // signaled when messages are buffered
+		polling  int           // number of polls currently waiting
+		lastSeen time.Time
+	}
+)
+
+// subscribePoll creates a long-poll subscription to the tags (and filter) in the
+// json body (or query) and responds with the id to poll it by (POST /subscribe/poll)
+func subscribePoll(rw http.ResponseWriter, req *http.Request) {
+	tags, filterText := queryTags(req), req.FormValue("filter")
+	if len(tags) == 0 && req.ContentLength != 0 {
+		msg := core.Message{}
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("Failed to parse message - %s", err.Error()))
+			return
+		}
+		tags, filterText = msg.Tags, msg.Filter
+	}
+
+	if len(tags) == 0 {
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("Unable to subscribe - missing tags"))
+		return
+	}
+
+	token, identity := authToken(req), reqIdentity(req)
+	if err := allowSubscribe(token, identity, tags); err != nil {
+		writeError(rw, http.StatusForbidden, err)
+		return
+	}
+
+	filter, err := parseFilter(filterText)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	p, err := newPoller(token, identity, tags, filter)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeBody(rw, http.StatusCreated, map[string]string{"id": p.id})
+}
+
+// poll responds with every message buffered since the last poll; if there aren't
+// any it waits for one, up to the timeout in the query (GET /subscribe/poll/:id?timeout=10s)
+func poll(rw http.ResponseWriter, req *http.Request) {
+	p, ok := findPoller(req)
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("Subscription not found"))
+		return
+	}
+
+	timeout := PollTimeout
+	if v := req.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, fmt.Errorf("Bad timeout - %s", err.Error()))
+			return
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	writeBody(rw, http.StatusOK, p.poll(req, timeout))
+}
+
+// unsubscribePoll closes a long-poll subscription (DELETE /subscribe/poll/:id)
+func unsubscribePoll(rw http.ResponseWriter, req *http.Request) {
+	p, ok := findPoller(req)
+	if !ok {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("Subscription not found"))
+		return
+	}
+
+	p.close()
+
+	writeBody(rw, http.StatusOK, map[string]string{"id": p.id})
+}
+
+// newPoller subscribes a new long-poll subscription to [tags], filtered by [filter]
+// if it isn't nil
+func newPoller(token, identity string, tags []string, filter *core.Filter) (*poller, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("Failed to generate subscription id - %s", err.Error())
+	}
+
+	p := &poller{
+		id:       hex.EncodeToString(b),
+		token:    token,
+		identity: identity,
+		proxy:    core.NewProxy(),
+		notify:   make(chan struct{}, 1),
+		lastSeen: time.Now(),
+	}
+	subscribeFiltered(p.proxy, tags, filter)
+
+	// buffer messages until they're polled (non-blocking)
+	go p.buffer()
+
+	pollersTex.Lock()
+	pollers[p.id] = p
+	pollersTex.Unlock()
+
+	reaper.Do(func() { go reap() })
+
+	return p, nil
+}
+
+// findPoller returns the long-poll subscription a request is for; it has to be
+// made with the same token (or client certificate) as the subscription
+func findPoller(req *http.Request) (*poller, bool) {
+	pollersTex.Lock()
+	p, ok := pollers[req.URL.Query().Get(":id")]
+	pollersTex.Unlock()
+
+	if !ok || p.token != authToken(req) || p.identity != reqIdentity(req) {
+		return nil, false
+	}
+
+	return p, true
+}
+
+// buffer reads everything off the proxy's pipe into the buffer until the proxy
+// is closed, or the subscription is closed for overflowing its buffer
+func (p *poller) buffer() {
+	for msg := range p.proxy.Pipe {
+		p.Lock()
+		kept := p.keep(msg)
+		p.Unlock()
+
+		if p.proxy.Overflowed() {
+			lumber.Debug("HTTP Poll buffer overflowed, closing subscription '%s'", p.id)
+			p.close()
+		}
+		if !kept {
+			continue
+		}
+
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// keep buffers [msg]; once the buffer is full the overflow policy decides
+// whether the oldest message or this one is dropped (counted like a full queue's
+// drops), or the proxy is disconnected. The poller has to be locked
+func (p *poller) keep(msg core.Message) bool {
+	if len(p.messages) >= PollBufferSize {
+		lumber.Debug("HTTP Poll buffer full, dropping message")
+		p.proxy.Overflow()
+
+		if core.OverflowPolicy != core.DropOldest || len(p.messages) == 0 {
+			return false
+		}
+		p.messages[0] = core.Message{} // let the message be collected
+		p.messages = p.messages[1:]
+	}
+
+	p.messages = append(p.messages, msg)
+	return true
+}
+
+// poll takes every buffered message, waiting up to [timeout] for one to arrive if
+// there aren't any; messages that expired while they were buffered are dropped
+func (p *poller) poll(req *http.Request, timeout time.Duration) []core.Message {
+	p.Lock()
+	p.polling++
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.polling--
+		p.lastSeen = time.Now()
+		p.Unlock()
+	}()
+
+	wait := time.NewTimer(timeout)
+	defer wait.Stop()
+
+	for {
+		p.Lock()
+		messages := core.DropExpired(p.messages)
+		p.messages = nil
+		p.Unlock()
+
+		if len(messages) != 0 {
+			return messages
+		}
+
+		select {
+		case <-p.notify:
+		case <-p.proxy.Disconnected():
+			return []core.Message{}
+		case <-wait.C:
+			return []core.Message{}
+		case <-req.Context().Done():
+			return []core.Message{}
+		}
+	}
+}
+
+// close unsubscribes the long-poll subscription and removes it
+func (p *poller) close() {
+	pollersTex.Lock()
+	_, ok := pollers[p.id]
+	delete(pollers, p.id)
+	pollersTex.Unlock()
+
+	// only the first close needs to close the proxy
+	if ok {
+		p.proxy.Close()
+	}
+}
+
+// reap closes long-poll subscriptions that haven't been polled in PollIdleTimeout
+func reap() {
+	for range time.Tick(PollIdleTimeout / 2) {
+		idle := []*poller{}
+
+		pollersTex.Lock()
+		for _, p := range pollers {
+			p.Lock()
+			if p.polling == 0 && time.Since(p.lastSeen) > PollIdleTimeout {
+				idle = append(idle, p)
+			}
+			p.Unlock()
+		}
+		pollersTex.Unlock()
+
+		for _, p := range idle {
+			lumber.Debug("HTTP Reaping idle poll subscription '%s'", p.id)
+			p.close()
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SteveWXT/pubsub/core"
+	"github.com/SteveWXT/pubsub/server"
+)
+
+// TestHTTPPoll tests that a long-poll subscription receives the messages
+// published between polls, and is reaped once it's no longer polled
+func TestHTTPPoll(t *testing.T) {
+	server.PollIdleTimeout = 500 * time.Millisecond
+
+	// subscribe, getting the id to poll by
+	res, err := http.Post("http://127.0.0.1:8080/subscribe/poll", "application/json", strings.NewReader(`{"tags":["poll"]}`))
+	if err != nil {
+		t.Fatalf("Failed to subscribe - %s", err.Error())
+	}
+	sub := map[string]string{}
+	json.NewDecoder(res.Body).Decode(&sub)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || sub["id"] == "" {
+		t.Fatalf("Unexpected response - %d %v", res.StatusCode, sub)
+	}
+	url := "http://127.0.0.1:8080/subscribe/poll/" + sub["id"]
+
+	// messages published before polling are buffered
+	core.Publish([]string{"poll"}, "one")
+	core.Publish([]string{"poll"}, "two")
+	time.Sleep(100 * time.Millisecond)
+
+	messages := []core.Message{}
+	getJSON(url, &messages, t)
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	// a poll with nothing buffered waits for the next message
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		core.Publish([]string{"poll"}, "three")
+	}()
+	getJSON(url+"?timeout=5s", &messages, t)
+	if len(messages) != 1 || messages[0].Data != "three" {
+		t.Fatalf("Unexpected messages - %v", messages)
+	}
+
+	// or times out empty
+	getJSON(url+"?timeout=100ms", &messages, t)
+	if len(messages) != 0 {
+		t.Fatalf("Unexpected messages - %v", messages)
+	}
+
+	// messages that expire before they're polled are dropped
+	core.PublishMessage(core.Message{Tags: []string{"poll"}, Data: "stale", TTL: "20ms"})
+	time.Sleep(100 * time.Millisecond)
+	getJSON(url+"?timeout=100ms", &messages, t)
+	if len(messages) != 0 {
+		t.Fatalf("Unexpected messages - %v", messages)
+	}
+
+	// once idle the subscription is reaped
+	time.Sleep(time.Second)
+	res, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to poll - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected idle subscription to be reaped, got %d", res.StatusCode)
+	}
+}
+
+// TestHTTPPollUnsubscribe tests that a long-poll subscription can be closed
+func TestHTTPPollUnsubscribe(t *testing.T) {
+	res, err := http.Post("http://127.0.0.1:8080/subscribe/poll?tags=poll", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe - %s", err.Error())
+	}
+	sub := map[string]string{}
+	json.NewDecoder(res.Body).Decode(&sub)
+	res.Body.Close()
+
+	req, _ := http.NewRequest("DELETE", "http://127.0.0.1:8080/subscribe/poll/"+sub["id"], nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to unsubscribe - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+
+	res, err = http.Get("http://127.0.0.1:8080/subscribe/poll/" + sub["id"])
+	if err != nil {
+		t.Fatalf("Failed to poll - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected closed subscription, got %d", res.StatusCode)
+	}
+}
+
+// TestHTTPPollOverflow tests that a long-poll subscription's full buffer drops
+// (or closes the subscription) according to the overflow policy
+func TestHTTPPollOverflow(t *testing.T) {
+	defer func(size int, policy string) { server.PollBufferSize, core.OverflowPolicy = size, policy }(server.PollBufferSize, core.OverflowPolicy)
+	server.PollBufferSize, core.OverflowPolicy = 2, core.DropNewest
+
+	subscribe := func() string {
+		res, err := http.Post("http://127.0.0.1:8080/subscribe/poll?tags=pollfull", "", nil)
+		if err != nil {
+			t.Fatalf("Failed to subscribe - %s", err.Error())
+		}
+		sub := map[string]string{}
+		json.NewDecoder(res.Body).Decode(&sub)
+		res.Body.Close()
+		return "http://127.0.0.1:8080/subscribe/poll/" + sub["id"]
+	}
+
+	// the newest messages are dropped, and counted
+	url := subscribe()
+	before := core.GetStats().Dropped
+	for _, data := range []string{"one", "two", "three"} {
+		core.Publish([]string{"pollfull"}, data)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	messages := []core.Message{}
+	getJSON(url, &messages, t)
+	if len(messages) != 2 || messages[0].Data != "one" || messages[1].Data != "two" {
+		t.Fatalf("Unexpected messages - %v", messages)
+	}
+	if dropped := core.GetStats().Dropped - before; dropped != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d", dropped)
+	}
+
+	// or the subscription is closed
+	core.OverflowPolicy = core.Disconnect
+	url = subscribe()
+	for _, data := range []string{"one", "two", "three"} {
+		core.Publish([]string{"pollfull"}, data)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to poll - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected overflowed subscription to be closed, got %d", res.StatusCode)
+	}
+}
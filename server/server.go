@@ -20,7 +20,7 @@ var (
 )
 
 type (
-	handleFunc func(uri string, errChan chan<- error)
+	handleFunc func(url *url.URL, errChan chan<- error)
 )
 
 // Register registers a new pubsub server
@@ -61,7 +61,7 @@ func Start(uris []string) error {
 
 		// attempt to start the server
 		lumber.Info("Starting '%s' server...", url.Scheme)
-		go server(url.Host, errChan)
+		go server(url, errChan)
 	}
 
 	// handle errors that happen during startup by reading off errChan and returning
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/SteveWXT/pubsub/auth"
+	"github.com/SteveWXT/pubsub/core"
 	"github.com/SteveWXT/pubsub/server"
 )
 
@@ -15,7 +17,7 @@ func TestStart(t *testing.T) {
 
 	go func() {
 		if err := server.Start([]string{"tcp://127.0.0.1:1446"}); err == nil {
-			t.Fatalf("Expecting error - %s", err.Error())
+			t.Errorf("Expecting error - %s", err.Error())
 		}
 	}()
 	<-time.After(time.Second)
@@ -30,8 +32,28 @@ func TestStartWithLS(t *testing.T) {
 
 	go func() {
 		if err := server.StartWithLS(ls); err == nil {
-			t.Fatalf("Expecting error - %s", err.Error())
+			t.Errorf("Expecting error - %s", err.Error())
 		}
 	}()
 	<-time.After(time.Second)
 }
+
+// TestTokenNotConfigured tests that managing tokens without an authenticator is
+// refused, even with the master token
+func TestTokenNotConfigured(t *testing.T) {
+	defer auth.SetDefault(auth.Default())
+	auth.SetDefault(nil)
+	auth.MasterToken = "master"
+	defer func() { auth.MasterToken = "" }()
+
+	proxy := core.NewProxy()
+	defer proxy.Close()
+	proxy.Token = "master"
+
+	handlers := server.GenerateHandlers()
+	for _, command := range []string{"token.add", "token.remove", "token.list"} {
+		if err := handlers[command](proxy, core.Message{Command: command, Data: `{"token":"new"}`}); err != auth.ErrNotConfigured {
+			t.Fatalf("Expected '%s' to fail, got '%v'", command, err)
+		}
+	}
+}
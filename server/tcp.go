@@ -1,20 +1,34 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
+	"sync"
 
 	"github.com/jcelliott/lumber"
 
+	"github.com/SteveWXT/pubsub/auth"
 	"github.com/SteveWXT/pubsub/core"
 )
 
-// init adds "tcp" as an available core server type
+// init adds "tcp" and "tls" as available core server types
 func init() {
-	Register("tcp", StartTCP)
+	Register("tcp", func(url *url.URL, errChan chan<- error) {
+		StartTCP(url.Host, errChan)
+	})
+	Register("tls", func(url *url.URL, errChan chan<- error) {
+		config, err := tlsConfig(url)
+		if err != nil {
+			errChan <- fmt.Errorf("Failed to start tls listener - %s", err.Error())
+			return
+		}
+		StartTLS(url.Host, config, errChan)
+	})
 }
 
 // StartTCP starts a tcp server listening on the specified address (default 127.0.0.1:1445)
@@ -31,20 +45,24 @@ func StartTCP(uri string, errChan chan<- error) {
 	lumber.Info("TCP server listening at '%s'...", uri)
 
 	// start continually listening for any incoming tcp connections (non-blocking)
-	go func() {
-		for {
+	go serveTCP(ln, errChan)
+}
 
-			// accept connections
-			conn, err := ln.Accept()
-			if err != nil {
-				errChan <- fmt.Errorf("Failed to accept TCP connection %s", err.Error())
-				return
-			}
+// StartTLS starts a tcp server listening on the specified address over tls, and
+// then continually reads from the server handling any incoming connections
+func StartTLS(uri string, config *tls.Config, errChan chan<- error) {
 
-			// handle each connection individually (non-blocking)
-			go handleConnection(conn, errChan)
-		}
-	}()
+	// start a TLS listener
+	ln, err := tls.Listen("tcp", uri, config)
+	if err != nil {
+		errChan <- fmt.Errorf("Failed to start tls listener - %s", err.Error())
+		return
+	}
+
+	lumber.Info("TLS server listening at '%s'...", uri)
+
+	// start continually listening for any incoming tls connections (non-blocking)
+	go serveTCP(ln, errChan)
 }
 
 // StartTCPWithLS starts a tcp server listening on the specified tcp listener
@@ -59,20 +77,24 @@ func StartTCPWithLS(ls net.Listener, errChan chan<- error) {
 	lumber.Info("TCP server listening at '%v'...", port)
 
 	// start continually listening for any incoming tcp connections (non-blocking)
-	go func() {
-		for {
+	go serveTCP(ls, errChan)
+}
 
-			// accept connections
-			conn, err := ls.Accept()
-			if err != nil {
-				errChan <- fmt.Errorf("Failed to accept TCP connection %s", err.Error())
-				return
-			}
+// serveTCP continually accepts connections from a listener, handling each of
+// them individually
+func serveTCP(ln net.Listener, errChan chan<- error) {
+	for {
 
-			// handle each connection individually (non-blocking)
-			go handleConnection(conn, errChan)
+		// accept connections
+		conn, err := ln.Accept()
+		if err != nil {
+			errChan <- fmt.Errorf("Failed to accept TCP connection %s", err.Error())
+			return
 		}
-	}()
+
+		// handle each connection individually (non-blocking)
+		go handleConnection(conn, errChan)
+	}
 }
 
 // handleConnection takes an incoming connection from a core client (or other client)
@@ -83,27 +105,67 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 	// close the connection when we're done here
 	defer conn.Close()
 
+	// a client failing the tls handshake is the client's problem, not the server's
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			lumber.Debug("TLS handshake failed - %s", err.Error())
+			return
+		}
+		s := tlsConn.ConnectionState()
+		state = &s
+	}
+
 	// create a new client for each connection
 	proxy := core.NewProxy()
 	defer proxy.Close()
 
+	// connections only need to authenticate if an authenticator is configured, and
+	// they didn't present a verified client certificate
+	proxy.Authenticated = !auth.IsConfigured()
+	identify(proxy, state)
+
 	// add basic TCP command handlers for this connection
 	handlers := GenerateHandlers()
 
 	encoder := json.NewEncoder(conn)
 	decoder := json.NewDecoder(conn)
 
+	// messages from the proxy are written by the goroutine below, while errors are
+	// written by the connection loop; they take turns, so they can't interleave
+	var writeTex sync.Mutex
+	write := func(msg *core.Message) error {
+		writeTex.Lock()
+		defer writeTex.Unlock()
+
+		return encoder.Encode(msg)
+	}
+
 	// publish core messages (pong, etc.. and messages if subscriber attatched)
 	// to connected tcp client (non-blocking)
 	go func() {
-		for msg := range proxy.Pipe {
-			lumber.Trace("Got message - %#v", msg)
-			// if the message fails to encode its probably a syntax issue and needs to
-			// break the loop here because it will never be able to encode it; this will
-			// disconnect the client.
-			if err := encoder.Encode(msg); err != nil {
-				errChan <- fmt.Errorf("Failed to pubilsh proxy.Pipe contents to TCP clients - %s", err.Error())
-				break
+		for {
+			select {
+			case msg, ok := <-proxy.Pipe:
+				if !ok {
+					return
+				}
+
+				lumber.Trace("Got message - %#v", msg)
+				// if the message fails to encode its probably a syntax issue and needs to
+				// break the loop here because it will never be able to encode it; this will
+				// disconnect the client.
+				if err := write(&msg); err != nil {
+					errChan <- fmt.Errorf("Failed to pubilsh proxy.Pipe contents to TCP clients - %s", err.Error())
+					return
+				}
+
+			// the client can't keep up with what it's subscribed to
+			case <-proxy.Disconnected():
+				lumber.Debug("TCP Client queue overflowed, disconnecting")
+				conn.Close()
+				drain(proxy)
+				return
 			}
 		}
 	}()
@@ -118,10 +180,12 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 		// break the loop here because it will never be able to decode it; this will
 		// disconnect the client.
 		if err := decoder.Decode(&msg); err != nil {
-			switch err {
-			case io.EOF:
+			switch {
+			case proxy.Overflowed():
+				lumber.Debug("Client disconnected for overflowing its queue")
+			case err == io.EOF:
 				lumber.Debug("Client disconnected")
-			case io.ErrUnexpectedEOF:
+			case err == io.ErrUnexpectedEOF:
 				lumber.Debug("Client disconnected unexpedtedly")
 			default:
 				errChan <- fmt.Errorf("Failed to decode message from TCP connection - %s", err.Error())
@@ -129,13 +193,24 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 			return
 		}
 
+		// until a connection authenticates the only command it may run is 'auth';
+		// anything else (or a bad token) returns an error and disconnects the client
+		if !proxy.Authenticated {
+			if err := authenticate(proxy, msg); err != nil {
+				lumber.Debug("TCP Failed to authenticate - %s", err.Error())
+				write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Error: err.Error()})
+				return
+			}
+			continue
+		}
+
 		// look for the command
 		handler, found := handlers[msg.Command]
 
 		// if the command isn't found, return an error and wait for the next command
 		if !found {
 			lumber.Trace("Command '%s' not found", msg.Command)
-			encoder.Encode(&core.Message{Command: msg.Command, Tags: msg.Tags, Data: msg.Data, Error: "Unknown Command"})
+			write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Tags: msg.Tags, Data: msg.Data, Error: "Unknown Command"})
 			continue
 		}
 
@@ -144,8 +219,15 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 		lumber.Trace("TCP Running '%s'...", msg.Command)
 		if err := handler(proxy, msg); err != nil {
 			lumber.Debug("TCP Failed to run '%s' - %s", msg.Command, err.Error())
-			encoder.Encode(&core.Message{Command: msg.Command, Error: err.Error()})
+			write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Error: err.Error()})
 			continue
 		}
 	}
 }
+
+// drain discards everything sent down a proxy's pipe until it's closed, so that
+// nothing sending to it blocks once its connection is gone
+func drain(proxy *core.Proxy) {
+	for range proxy.Pipe {
+	}
+}
@@ -1,10 +1,13 @@
 package server_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/SteveWXT/pubsub/core"
 	"github.com/SteveWXT/pubsub/server"
 )
 
@@ -13,8 +16,35 @@ func TestTCPStart(t *testing.T) {
 
 	go func() {
 		if err := server.Start([]string{"tcp://127.0.0.1:1445"}); err != nil {
-			t.Fatalf("Unexpected error - %s", err.Error())
+			t.Errorf("Unexpected error - %s", err.Error())
 		}
 	}()
 	<-time.After(time.Second)
 }
+
+// TestTCPMissingTags tests that subscribing or unsubscribing without tags is
+// refused, rather than acked having done nothing
+func TestTCPMissingTags(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:1445")
+	if err != nil {
+		t.Fatalf("Failed to connect - %s", err.Error())
+	}
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	for _, command := range []string{"subscribe", "unsubscribe"} {
+		if err := encoder.Encode(core.Message{Command: command, RequestID: command}); err != nil {
+			t.Fatalf("Failed to send '%s' - %s", command, err.Error())
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		msg := core.Message{}
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("Failed to read '%s' response - %s", command, err.Error())
+		}
+		if msg.RequestID != command || msg.Error != fmt.Sprintf("Unable to %s - missing tags", command) {
+			t.Fatalf("Unexpected response - %#v", msg)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/SteveWXT/pubsub/core"
+)
+
+var (
+	// TLSCert and TLSKey are the certificate and key files used by the tls, wss
+	// and https listeners when their uri doesn't provide its own (?cert=&key=)
+	TLSCert string
+	TLSKey  string
+
+	// TLSClientCA is the CA file tls, wss and https listeners verify client
+	// certificates with when their uri doesn't provide its own (?client-ca=)
+	TLSClientCA string
+)
+
+// tlsConfig loads the certificate and key for a tls listener from the query of
+// its uri, falling back to TLSCert and TLSKey
+func tlsConfig(url *url.URL) (*tls.Config, error) {
+	certFile, keyFile := url.Query().Get("cert"), url.Query().Get("key")
+	if certFile == "" {
+		certFile = TLSCert
+	}
+	if keyFile == "" {
+		keyFile = TLSKey
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("Missing tls certificate or key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load tls certificate - %s", err.Error())
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// with a client CA, clients presenting a certificate it verifies are identified
+	// by it; clients without one can still authenticate with a token
+	clientCA := url.Query().Get("client-ca")
+	if clientCA == "" {
+		clientCA = TLSClientCA
+	}
+
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read client CA - %s", err.Error())
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to parse client CA '%s'", clientCA)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// identify authenticates a proxy by the client certificate of its connection,
+// if it presented one that was verified
+func identify(proxy *core.Proxy, state *tls.ConnectionState) {
+	if identity := certIdentity(state); identity != "" {
+		proxy.Identity = identity
+		proxy.Authenticated = true
+	}
+}
+
+// certIdentity returns the identity of a connection's verified client certificate;
+// the common name of its subject, or its first SAN if it doesn't have one
+func certIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) != 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) != 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) != 0:
+		return cert.EmailAddresses[0]
+	}
+
+	return ""
+}
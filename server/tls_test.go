@@ -0,0 +1,212 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/SteveWXT/pubsub/auth"
+	"github.com/SteveWXT/pubsub/clients"
+	"github.com/SteveWXT/pubsub/core"
+	"github.com/SteveWXT/pubsub/server"
+)
+
+// TestTLSStart tests to ensure tls, wss and https servers start and can be
+// connected to securely
+func TestTLSStart(t *testing.T) {
+	fmt.Println("Starting TLS test...")
+
+	dir, err := ioutil.TempDir("", "pubsub-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	pool, certFile, keyFile := writeCert(dir, t)
+	query := fmt.Sprintf("?cert=%s&key=%s", certFile, keyFile)
+
+	go func() {
+		if err := server.Start([]string{"tls://127.0.0.1:1447" + query, "https://127.0.0.1:8443" + query, "wss://127.0.0.1:8889" + query}); err != nil {
+			t.Errorf("Unexpected error - %s", err.Error())
+		}
+	}()
+	<-time.After(time.Second)
+
+	config := &tls.Config{RootCAs: pool}
+
+	// tls
+	client, err := clients.New("127.0.0.1:1447", clients.WithTLS(config))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+	if err := client.Ping(); err != nil {
+		t.Fatalf("ping failed - %s", err.Error())
+	}
+
+	// a client that doesn't trust the certificate can't connect
+	if _, err := clients.New("127.0.0.1:1447", clients.WithTLS(&tls.Config{})); err == nil {
+		t.Fatalf("Client connected without verifying the server")
+	}
+
+	// https
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	res, err := httpClient.Get("https://127.0.0.1:8443/ping")
+	if err != nil {
+		t.Fatalf("Failed to ping https - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+
+	// wss
+	dialer := websocket.Dialer{TLSClientConfig: config}
+	conn, _, err := dialer.Dial("wss://127.0.0.1:8889/subscribe/websocket", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial wss - %s", err.Error())
+	}
+	defer conn.Close()
+	conn.WriteJSON(core.Message{Command: "ping"})
+	msg := core.Message{}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Data != "pong" {
+		t.Fatalf("Unexpected wss reply - %#v %v", msg, err)
+	}
+}
+
+// TestTLSClientCert tests that clients presenting a certificate signed by the
+// client CA are identified by it, and don't need a token
+func TestTLSClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubsub-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir - %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// the server's certificate doubles as the client CA
+	pool, certFile, keyFile := writeCert(dir, t)
+	query := fmt.Sprintf("?cert=%s&key=%s&client-ca=%s", certFile, keyFile, certFile)
+
+	if err := auth.Start("memory://?token=secret"); err != nil {
+		t.Fatalf("Failed to start authenticator - %s", err.Error())
+	}
+	defer auth.SetDefault(nil)
+	auth.Default().SetIdentityACL("billing-service", &auth.ACL{Subscribe: [][]string{{"billing"}}})
+
+	go func() {
+		if err := server.Start([]string{"tls://127.0.0.1:1448" + query}); err != nil {
+			t.Errorf("Unexpected error - %s", err.Error())
+		}
+	}()
+	<-time.After(time.Second)
+
+	// without a certificate (or token) the client isn't authenticated
+	if _, err := clients.New("127.0.0.1:1448", clients.WithTLS(&tls.Config{RootCAs: pool})); err == nil {
+		t.Fatalf("Client connected without authenticating")
+	}
+
+	config := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert(certFile, keyFile, "billing-service", t)}}
+	client, err := clients.New("127.0.0.1:1448", clients.WithTLS(config))
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	// the identity's ACL applies
+	if err := client.Subscribe([]string{"orders"}); err == nil {
+		t.Fatalf("Unexpected subscribe allowed!")
+	}
+	if err := client.Subscribe([]string{"billing"}); err != nil {
+		t.Fatalf("client subscriptions failed %s", err.Error())
+	}
+
+	if who, err := client.Who(); err != nil || !strings.Contains(who, "billing-service") {
+		t.Fatalf("Identity missing from who - '%v' '%s'", err, who)
+	}
+}
+
+// clientCert creates a client certificate for [name], signed by the CA in [caFile]
+func clientCert(caFile, caKeyFile, name string, t *testing.T) tls.Certificate {
+	ca, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load CA - %s", err.Error())
+	}
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key - %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate - %s", err.Error())
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeCert writes a self-signed certificate (and its key) for 127.0.0.1 to [dir],
+// returning a pool that trusts it and the files' paths
+func writeCert(dir string, t *testing.T) (*x509.CertPool, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key - %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pubsub test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate - %s", err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key - %s", err.Error())
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return pool, certFile, keyFile
+}
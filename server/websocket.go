@@ -1,24 +1,55 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/pat"
 	"github.com/gorilla/websocket"
 	"github.com/jcelliott/lumber"
 
+	"github.com/SteveWXT/pubsub/auth"
 	"github.com/SteveWXT/pubsub/core"
 )
 
 // init adds ws/wss as available core server types
 func init() {
-	Register("ws", StartWS)
+	Register("ws", func(url *url.URL, errChan chan<- error) {
+		StartWS(url.Host, errChan)
+	})
+	Register("wss", func(url *url.URL, errChan chan<- error) {
+		config, err := tlsConfig(url)
+		if err != nil {
+			errChan <- fmt.Errorf("Failed to start wss listener - %s", err.Error())
+			return
+		}
+		StartWSS(url.Host, config, errChan)
+	})
 }
 
 // StartWS starts a core server listening over a websocket
 func StartWS(uri string, errChan chan<- error) {
+	lumber.Info("WS server listening at '%s'...\n", uri)
+	http.ListenAndServe(uri, wsRoutes(errChan))
+}
+
+// StartWSS starts a core server listening over a websocket secured with tls
+func StartWSS(uri string, config *tls.Config, errChan chan<- error) {
+	server := &http.Server{Addr: uri, Handler: wsRoutes(errChan), TLSConfig: config}
+
+	lumber.Info("WSS server listening at '%s'...\n", uri)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		errChan <- fmt.Errorf("Unable to start wss listener - %s", err.Error())
+	}
+}
+
+// wsRoutes returns a router that upgrades connections to websockets and then
+// handles the commands sent over them
+func wsRoutes(errChan chan<- error) *pat.Router {
 	router := pat.New()
 	router.Get("/subscribe/websocket", func(rw http.ResponseWriter, req *http.Request) {
 
@@ -39,25 +70,63 @@ func StartWS(uri string, errChan chan<- error) {
 		}
 		defer conn.Close()
 
+		// a websocket can only have one writer at a time; messages from the proxy are
+		// written by the goroutine below, while errors are written by the connection
+		// loop, so they take turns
+		var writeTex sync.Mutex
+		write := func(msg *core.Message) error {
+			writeTex.Lock()
+			defer writeTex.Unlock()
+
+			return conn.WriteJSON(msg)
+		}
+
 		proxy := core.NewProxy()
 		defer proxy.Close()
 
+		// connections only need to authenticate if an authenticator is configured, and
+		// they didn't present a verified client certificate
+		proxy.Authenticated = !auth.IsConfigured()
+		identify(proxy, req.TLS)
+
+		// browsers can't set headers on a websocket, so the token may also be passed
+		// as a query param; connections without either can still send 'auth'
+		if token := authToken(req); !proxy.Authenticated && token != "" {
+			if err := handleAuth(proxy, core.Message{Command: "auth", Data: token}); err != nil {
+				write(&core.Message{Command: "auth", Error: err.Error()})
+				return
+			}
+		}
+
 		// add basic WS handlers for this socket
 		handlers := GenerateHandlers()
 
 		// read and publish core messages to connected clients (non-blocking)
 		go func() {
-			for msg := range proxy.Pipe {
-
-				// failing to write is probably because the connection is dead; we dont
-				// want core just looping forever tyring to write to something it will
-				// never be able to.
-				if err := conn.WriteJSON(msg); err != nil {
-					if err.Error() != "websocket: close sent" {
-						errChan <- fmt.Errorf("Failed to WriteJSON message to WS connection - %s", err.Error())
+			for {
+				select {
+				case msg, ok := <-proxy.Pipe:
+					if !ok {
+						return
 					}
 
-					break
+					// failing to write is probably because the connection is dead; we dont
+					// want core just looping forever tyring to write to something it will
+					// never be able to.
+					if err := write(&msg); err != nil {
+						if err.Error() != "websocket: close sent" {
+							errChan <- fmt.Errorf("Failed to WriteJSON message to WS connection - %s", err.Error())
+						}
+
+						return
+					}
+
+				// the client can't keep up with what it's subscribed to
+				case <-proxy.Disconnected():
+					lumber.Debug("WS Client queue overflowed, disconnecting")
+					conn.Close()
+					drain(proxy)
+					return
 				}
 			}
 		}()
@@ -74,7 +143,8 @@ func StartWS(uri string, errChan chan<- error) {
 			// never be able to.
 			if err := conn.ReadJSON(&msg); err != nil {
 				// todo: better logging here too
-				if !strings.Contains(err.Error(), "websocket: close 1001") &&
+				if !proxy.Overflowed() &&
+					!strings.Contains(err.Error(), "websocket: close 1001") &&
 					!strings.Contains(err.Error(), "websocket: close 1005") &&
 					!strings.Contains(err.Error(), "websocket: close 1006") { // don't log if client disconnects
 					errChan <- fmt.Errorf("Failed to ReadJson message from WS connection - %s", err.Error())
@@ -83,13 +153,26 @@ func StartWS(uri string, errChan chan<- error) {
 				break // todo: continue?
 			}
 
+			// until a connection authenticates the only command it may run is 'auth';
+			// anything else (or a bad token) returns an error and disconnects the client
+			if !proxy.Authenticated {
+				if err := authenticate(proxy, msg); err != nil {
+					lumber.Debug("WS Failed to authenticate - %s", err.Error())
+					if err := write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Error: err.Error()}); err != nil {
+						errChan <- fmt.Errorf("WS Failed to respond to client with error - %s", err.Error())
+					}
+					break
+				}
+				continue
+			}
+
 			// look for the command
 			handler, found := handlers[msg.Command]
 
 			// if the command isn't found, return an error
 			if !found {
 				lumber.Trace("Command '%s' not found", msg.Command)
-				if err := conn.WriteJSON(&core.Message{Command: msg.Command, Error: "Unknown Command"}); err != nil {
+				if err := write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Error: "Unknown Command"}); err != nil {
 					errChan <- fmt.Errorf("WS Failed to respond to client with 'command not found' - %s", err.Error())
 				}
 				continue
@@ -99,7 +182,7 @@ func StartWS(uri string, errChan chan<- error) {
 			lumber.Trace("WS Running '%s'...", msg.Command)
 			if err := handler(proxy, msg); err != nil {
 				lumber.Debug("WS Failed to run '%s' - %s", msg.Command, err.Error())
-				if err := conn.WriteJSON(&core.Message{Command: msg.Command, Error: err.Error()}); err != nil {
+				if err := write(&core.Message{Command: msg.Command, RequestID: msg.RequestID, Error: err.Error()}); err != nil {
 					errChan <- fmt.Errorf("WS Failed to respond to client with error - %s", err.Error())
 				}
 				continue
@@ -107,7 +190,5 @@ func StartWS(uri string, errChan chan<- error) {
 		}
 	})
 
-	lumber.Info("WS server listening at '%s'...\n", uri)
-	// go http.ListenAndServe(uri, router)
-	http.ListenAndServe(uri, router)
+	return router
 }
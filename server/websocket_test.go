@@ -14,7 +14,7 @@ func TestWSStart(t *testing.T) {
 
 	go func() {
 		if err := server.Start([]string{"ws://127.0.0.1:8888"}); err != nil {
-			t.Fatalf("Unexpected error - %s", err.Error())
+			t.Errorf("Unexpected error - %s", err.Error())
 		}
 	}()
 	<-time.After(time.Second)